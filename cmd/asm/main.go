@@ -5,27 +5,123 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/bassosimone/risc32/pkg/asm"
+	"github.com/bassosimone/risc32/pkg/vm"
 )
 
 func main() {
 	log.SetFlags(0)
+	datamap := flag.String("datamap", "", "optional file where to write the ranges containing data")
+	fatal := flag.Bool("fatal", false, "stop at the first error")
 	filename := flag.String("f", "", "file to process")
+	gosrc := flag.Bool("go", false, "emit Go source code rather than machine code")
+	lines := flag.String("lines", "", "optional file where to write the address to line table")
+	listing := flag.Bool("listing", false, "emit a listing rather than machine code")
+	optimize := flag.Bool("O", false, "enable the peephole optimizer")
+	name := flag.String("name", "program", "name of the variable emitted with -go")
+	symbols := flag.String("s", "", "optional file where to write the symbol table")
 	flag.Parse()
-	if *filename == "" {
-		log.Fatal("usage: asm -f <assembly-code-file>")
+	if *filename == "" || (*gosrc && *listing) {
+		log.Fatal("usage: asm [-O] [-datamap <data-map-file>] [-fatal] [-go [-name <var>]|-listing] [-lines <line-table-file>] [-s <symbol-table-file>] -f <assembly-code-file>")
 	}
 	fp, err := os.Open(*filename)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer fp.Close()
-	for instr := range asm.StartAssembler(fp) {
-		out, err := instr.Encode()
+	var linesfp *os.File
+	if *lines != "" {
+		linesfp, err = os.Create(*lines)
 		if err != nil {
 			log.Fatal(err)
 		}
-		fmt.Print(out)
+		defer linesfp.Close()
+	}
+	var datafp *os.File
+	if *datamap != "" {
+		datafp, err = os.Create(*datamap)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer datafp.Close()
+	}
+	var symfp *os.File
+	if *symbols != "" {
+		symfp, err = os.Create(*symbols)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer symfp.Close()
+	}
+	var (
+		addr   uint32
+		data   []vm.DataRange
+		body   strings.Builder
+		failed bool
+		header string
+		words  []uint32
+	)
+	config := asm.Config{BaseDir: filepath.Dir(*filename), Optimize: *optimize}
+	if *fatal {
+		config.MaxErrors = 1
+	}
+	for instr := range asm.StartAssemblerWithConfig(fp, config) {
+		out, err := instr.Encode()
+		if *listing {
+			out, err = instr.Listing(addr)
+		}
+		if err != nil {
+			log.Print(err)
+			failed = true
+			continue
+		}
+		if instr.Warning != nil {
+			log.Printf("warning: %s", instr.Warning.Error())
+		}
+		if instr.Entry {
+			header = fmt.Sprintf("%s 0x%08x\n", vm.BytecodeEntry, addr)
+		}
+		words = append(words, instr.Instruction)
+		body.WriteString(out)
+		if linesfp != nil {
+			file := instr.File
+			if file == "" {
+				file = *filename
+			}
+			fmt.Fprintf(linesfp, "0x%08x %s:%d\n", instr.Address, file, instr.Lineno)
+		}
+		if instr.Data {
+			if n := len(data); n > 0 && data[n-1].Addr+data[n-1].Count == addr {
+				data[n-1].Count++
+			} else {
+				data = append(data, vm.DataRange{Addr: addr, Count: 1})
+			}
+		}
+		if symfp != nil && instr.Label != "" {
+			fmt.Fprintf(symfp, "0x%08x %s\n", addr, instr.Label)
+		}
+		addr++
+	}
+	if failed {
+		os.Exit(1)
+	}
+	if datafp != nil {
+		for _, r := range data {
+			fmt.Fprintf(datafp, "0x%08x %d\n", r.Addr, r.Count)
+		}
+	}
+	if *gosrc {
+		if header != "" {
+			header = "// " + strings.TrimPrefix(header, "# ")
+		}
+		fmt.Print(header + asm.GoSource(*name, words))
+		return
+	}
+	if !*listing {
+		fmt.Fprintf(&body, "%s 0x%08x\n", vm.BytecodeChecksum, vm.Checksum(words))
 	}
+	fmt.Print(header + body.String())
 }
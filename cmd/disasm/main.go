@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/bassosimone/risc32/pkg/vm"
+)
+
+func main() {
+	log.SetFlags(0)
+	datamap := flag.String("datamap", "", "optional file listing the ranges containing data")
+	filename := flag.String("f", "", "file to disassemble")
+	nosregs := flag.Bool("nosregs", false, "do not print the names of status registers")
+	pseudo := flag.Bool("pseudo", false, "reconstruct pseudo-instructions")
+	symbols := flag.String("s", "", "optional symbol table file")
+	verbose := flag.Bool("v", false, "show the decoded fields of each instruction")
+	flag.Parse()
+	if *filename == "" || (*pseudo && *verbose) {
+		log.Fatal("usage: disasm [-datamap <data-map-file>] [-nosregs] [-pseudo|-v] [-s <symbol-table-file>] -f <machine-code-file>")
+	}
+	fp, err := os.Open(*filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fp.Close()
+	words, err := vm.ReadBytecode(fp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	syms := make(map[uint32]string)
+	if *symbols != "" {
+		sfp, err := os.Open(*symbols)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer sfp.Close()
+		syms, err = vm.ReadSymbols(sfp)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var data vm.DataRanges
+	if *datamap != "" {
+		dfp, err := os.Open(*datamap)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer dfp.Close()
+		data, err = vm.ReadDataRanges(dfp)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	opts := options{nosregs: *nosregs, pseudo: *pseudo, verbose: *verbose}
+	disassemble(os.Stdout, words, syms, data, opts)
+}
+
+// options contains the flags controlling the disassembly.
+type options struct {
+	nosregs bool // do not print the names of status registers
+	pseudo  bool // reconstruct pseudo-instructions
+	verbose bool // show the decoded fields of each instruction
+}
+
+// disassemble writes into w the disassembly of words, which we assume
+// to be loaded starting from address zero, using syms to print labels
+// and showing the words within data as data words.
+func disassemble(w io.Writer, words []uint32, syms map[uint32]string,
+	data vm.DataRanges, opts options) {
+	format := vm.DisassembleAt
+	if opts.pseudo {
+		format = vm.DisassemblePseudo
+	}
+	if opts.verbose {
+		format = func(ci, addr uint32, syms map[uint32]string) string {
+			return vm.DisassembleVerbose(ci)
+		}
+	}
+	for addr, ci := range words {
+		if name, found := syms[uint32(addr)]; found {
+			fmt.Fprintf(w, "%s:\n", name)
+		}
+		text := format(ci, uint32(addr), syms)
+		if op := vm.DecodeOpcode(ci); opts.nosregs && (op == vm.OpcodeWSR || op == vm.OpcodeRSR) {
+			text = vm.Disassemble(ci)
+		}
+		if data.Contains(uint32(addr)) {
+			text = vm.DisassembleData(ci)
+		}
+		fmt.Fprintf(w, "0x%08x: 0x%08x  %s\n", addr, ci, text)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bassosimone/risc32/pkg/vm"
+)
+
+// countdown is a small program counting down from three:
+//
+//     addi r1 r0 3
+//     loop: addi r1 r1 -1
+//     beq r1 r0 done
+//     beq r0 r0 loop
+//     done: halt
+//     value: .fill 42
+var countdown = []uint32{
+	0x10400003,
+	0x1043ffff,
+	0x38400001,
+	0x3801fffd,
+	0x00000000,
+	0x0000002a,
+}
+
+// countdownSyms is the symbol table of countdown.
+var countdownSyms = map[uint32]string{
+	1: "loop",
+	4: "done",
+	5: "value",
+}
+
+func TestDisassemble(t *testing.T) {
+	var testcases = []struct {
+		name   string
+		opts   options
+		data   vm.DataRanges
+		expect string
+	}{{
+		name: "default",
+		expect: "0x00000000: 0x10400003  addi r1 r0 3\n" +
+			"loop:\n" +
+			"0x00000001: 0x1043ffff  addi r1 r1 -1\n" +
+			"0x00000002: 0x38400001  beq r1 r0 =>done\n" +
+			"0x00000003: 0x3801fffd  beq r0 r0 =>loop\n" +
+			"done:\n" +
+			"0x00000004: 0x00000000  jalr r0 r0 0\n" +
+			"value:\n" +
+			"0x00000005: 0x0000002a  jalr r0 r0 42\n",
+	}, {
+		name: "pseudo",
+		opts: options{pseudo: true},
+		expect: "0x00000000: 0x10400003  addi r1 r0 3\n" +
+			"loop:\n" +
+			"0x00000001: 0x1043ffff  addi r1 r1 -1\n" +
+			"0x00000002: 0x38400001  beq r1 r0 =>done\n" +
+			"0x00000003: 0x3801fffd  jmp =>loop\n" +
+			"done:\n" +
+			"0x00000004: 0x00000000  halt\n" +
+			"value:\n" +
+			"0x00000005: 0x0000002a  trap 42\n",
+	}, {
+		name: "datamap",
+		opts: options{pseudo: true},
+		data: vm.DataRanges{{Addr: 5, Count: 1}},
+		expect: "0x00000000: 0x10400003  addi r1 r0 3\n" +
+			"loop:\n" +
+			"0x00000001: 0x1043ffff  addi r1 r1 -1\n" +
+			"0x00000002: 0x38400001  beq r1 r0 =>done\n" +
+			"0x00000003: 0x3801fffd  jmp =>loop\n" +
+			"done:\n" +
+			"0x00000004: 0x00000000  halt\n" +
+			"value:\n" +
+			"0x00000005: 0x0000002a  .word 0x0000002a\n",
+	}, {
+		name: "verbose",
+		opts: options{verbose: true},
+		expect: "0x00000000: 0x10400003  addi r1 r0 3 [op=2 ra=1 rb=0 rc=3 imm17=3 imm22=3]\n" +
+			"loop:\n" +
+			"0x00000001: 0x1043ffff  addi r1 r1 -1 [op=2 ra=1 rb=1 rc=31 imm17=-1 imm22=262143]\n" +
+			"0x00000002: 0x38400001  beq r1 r0 1 [op=7 ra=1 rb=0 rc=1 imm17=1 imm22=1]\n" +
+			"0x00000003: 0x3801fffd  beq r0 r0 -3 [op=7 ra=0 rb=0 rc=29 imm17=-3 imm22=131069]\n" +
+			"done:\n" +
+			"0x00000004: 0x00000000  jalr r0 r0 0 [op=0 ra=0 rb=0 rc=0 imm17=0 imm22=0]\n" +
+			"value:\n" +
+			"0x00000005: 0x0000002a  jalr r0 r0 42 [op=0 ra=0 rb=0 rc=10 imm17=42 imm22=42]\n",
+	}}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			disassemble(&out, countdown, countdownSyms, tc.data, tc.opts)
+			if out.String() != tc.expect {
+				t.Fatalf("expected:\n%s\ngot:\n%s", tc.expect, out.String())
+			}
+		})
+	}
+}
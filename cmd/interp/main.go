@@ -1,68 +1,137 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"flag"
-	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 
+	"github.com/bassosimone/risc32/internal/cmdutil"
 	"github.com/bassosimone/risc32/pkg/asm"
 	"github.com/bassosimone/risc32/pkg/vm"
 )
 
 func main() {
 	log.SetFlags(0)
+	coredump := flag.String("coredump", "", "optional file where to write a core dump when the VM stops")
 	debug := flag.Bool("d", false, "enable debugging")
+	var data cmdutil.DataFlag
+	flag.Var(&data, "data", "load the content of file at addr (addr=file, may be repeated)")
+	disk := flag.String("disk", "", "optional file to use as disk")
+	entry := flag.String("entry", "", "optional address of the first instruction to execute")
 	filename := flag.String("f", "", "file to run")
+	interactive := flag.Bool("interactive", false, "run the interactive monitor")
+	interrupts := flag.Uint("interrupts", vm.NumInterrupts, "number of entries in the interrupt table")
+	lenient := flag.Bool("lenient", false, "ignore instructions with unknown opcodes")
+	memsize := flag.Uint("memsize", vm.MemorySize, "memory size in words")
+	optimize := flag.Bool("O", false, "enable the peephole optimizer")
+	strict := flag.Bool("strict", false, "fail when writing into r0")
+	poison := flag.Bool("poison", false, "fill memory with a word that fails when executed")
+	profile := flag.Bool("profile", false, "print how many times we executed each opcode")
+	stdtty := flag.Bool("stdtty", false, "enable tty using stdin and stdout")
+	trace := flag.String("trace", "", "optional file where to write the execution trace")
 	tty := flag.Bool("tty", false, "enable tty")
+	ttyaddr := flag.String("ttyaddr", "127.0.0.1:0", "address where -tty listens for the console")
+	timeout := flag.Duration("timeout", 0, "optional maximum running time (e.g., 10s)")
 	verbose := flag.Bool("v", false, "be verbose")
 	flag.Parse()
-	if *filename == "" {
-		log.Fatal("usage: interp [-d] [-tty] [-v] -f <assembly-code-file>")
+	if *filename == "" || (*stdtty && *tty) || (*stdtty && *interactive) {
+		log.Fatal("usage: interp [-O] [-coredump <file>] [-d] [-data <addr=file>] [-disk <file>] [-entry <addr>] [-interactive] [-interrupts <count>] [-lenient] [-memsize <words>] [-poison] [-profile] [-stdtty|-tty [-ttyaddr <addr>]] [-strict] [-timeout <duration>] [-trace <file>] [-v] -f <assembly-code-file>")
 	}
-	machine := new(vm.VM)
+	machine := vm.NewVM(uint32(*memsize))
+	machine.NI = uint32(*interrupts)
+	machine.LenientOpcodes = *lenient
+	machine.PoisonMemory = *poison
+	machine.StrictR0 = *strict
 	fp, err := os.Open(*filename)
 	if err != nil {
 		log.Fatal(err)
 	}
 	if *tty {
-		stty, err := vm.TTYAcceptConn()
+		stty, err := vm.TTYAcceptConn(context.Background(), *ttyaddr)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer stty.Close()
 		machine.TTY = stty
 	}
+	if *stdtty {
+		stty := vm.NewStdioTTY(os.Stdin, os.Stdout)
+		defer stty.Close()
+		machine.TTY = stty
+	}
 	defer fp.Close()
-	var addr uint32
-	for instr := range asm.StartAssembler(fp) {
+	if *disk != "" {
+		fdisk, err := vm.OpenFileDisk(*disk)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fdisk.Close()
+		machine.Disk = fdisk
+	}
+	if *trace != "" {
+		tfp, err := os.Create(*trace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer tfp.Close()
+		machine.TraceWriter = tfp
+	}
+	var (
+		addr    uint32
+		program []uint32
+	)
+	config := asm.Config{
+		BaseDir:    filepath.Dir(*filename),
+		MemorySize: int(*memsize),
+		Optimize:   *optimize,
+	}
+	for instr := range asm.StartAssemblerWithConfig(fp, config) {
 		if instr.Error != nil {
 			log.Fatal(instr.Error)
 		}
-		machine.M[addr] = instr.Instruction
+		if instr.Warning != nil {
+			log.Printf("warning: %s", instr.Warning.Error())
+		}
+		if instr.Entry {
+			machine.PC = addr
+		}
+		if addr >= machine.MemoryWords() {
+			log.Fatalf("%s: program larger than %d words", vm.ErrImageTooLarge, machine.MemoryWords())
+		}
+		program = append(program, instr.Instruction)
 		addr++
 	}
-	for {
-		ci, err := machine.Fetch()
+	if err := machine.Load(program, 0); err != nil {
+		log.Fatal(err)
+	}
+	if err := cmdutil.LoadData(machine, data); err != nil {
+		log.Fatal(err)
+	}
+	if *entry != "" {
+		value, err := strconv.ParseUint(*entry, 0, 32)
 		if err != nil {
 			log.Fatal(err)
 		}
-		if *verbose || (machine.StatusDebug()&vm.StatusDebugTracing) != 0 {
-			log.Printf("vm: %s", machine)
-			log.Printf("vm: %#032b %s\n", ci, vm.Disassemble(ci))
-			log.Printf("vm: S[3]: %d", machine.S[3])
-			log.Printf("vm: stack (r29): %d", machine.GPR[29])
-		}
-		if *debug || (machine.StatusDebug()&vm.StatusDebugStepping) != 0 {
-			log.Printf("vm: paused...")
-			fmt.Scanln()
-		}
-		if err := machine.Execute(ci); err != nil {
-			if errors.Is(err, vm.ErrHalted) {
-				break
-			}
+		machine.PC = uint32(value)
+	}
+	if *interactive {
+		if err := monitor(machine, os.Stdin, os.Stdout); err != nil {
 			log.Fatal(err)
 		}
+		return
+	}
+	machine.Tracer = cmdutil.Debugger{
+		Debug:   *debug,
+		Status:  true,
+		Verbose: *verbose,
+	}
+	if err := cmdutil.Run(machine, *timeout, *coredump); err != nil {
+		log.Fatal(err)
+	}
+	if *profile {
+		log.Print(machine.ProfileReport())
 	}
 }
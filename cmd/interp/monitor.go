@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bassosimone/risc32/pkg/asm"
+	"github.com/bassosimone/risc32/pkg/vm"
+)
+
+// monitorHelp is the help message of the monitor.
+const monitorHelp = `commands:
+  asm <instruction>   assemble and execute an instruction (no jumps)
+  continue            run until the VM halts or faults
+  help                print this help message
+  mem <addr> [count]  print count (default: 1) words of physical memory
+  quit                leave the monitor
+  reg [-v]            print the registers (-v: also as signed decimals)
+  set <rN|addr> <val> set a register or a word of physical memory
+  step [count]        execute count (default: 1) instructions
+`
+
+// monitor runs the interactive monitor reading commands from r and
+// writing their output to w until the input ends or we see `quit`.
+func monitor(machine *vm.VM, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	for {
+		fmt.Fprintf(w, "(0x%08x) ", machine.PC)
+		if !scanner.Scan() {
+			fmt.Fprintln(w)
+			return scanner.Err()
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" {
+			return nil
+		}
+		if err := monitorCommand(machine, fields, w); err != nil {
+			fmt.Fprintf(w, "error: %s\n", err.Error())
+		}
+	}
+}
+
+// monitorCommand executes the command described by fields.
+func monitorCommand(machine *vm.VM, fields []string, w io.Writer) error {
+	switch fields[0] {
+	case "asm":
+		return monitorAsm(machine, strings.Join(fields[1:], " "), w)
+	case "continue":
+		return monitorStep(machine, -1, w)
+	case "help":
+		fmt.Fprint(w, monitorHelp)
+		return nil
+	case "mem":
+		return monitorMem(machine, fields[1:], w)
+	case "reg":
+		if len(fields) > 1 && fields[1] == "-v" {
+			fmt.Fprint(w, machine.RegistersString())
+			return nil
+		}
+		fmt.Fprintf(w, "PC: 0x%08x\n", machine.PC)
+		for idx, value := range machine.GPR {
+			fmt.Fprintf(w, "r%-2d: 0x%08x", idx, value)
+			if idx%4 == 3 {
+				fmt.Fprintln(w)
+			} else {
+				fmt.Fprint(w, "  ")
+			}
+		}
+		for idx, value := range machine.S {
+			fmt.Fprintf(w, "S[%d]: 0x%08x\n", idx, value)
+		}
+		return nil
+	case "set":
+		return monitorSet(machine, fields[1:])
+	case "step":
+		count := int64(1)
+		if len(fields) > 1 {
+			var err error
+			if count, err = strconv.ParseInt(fields[1], 0, 64); err != nil {
+				return err
+			}
+		}
+		return monitorStep(machine, count, w)
+	default:
+		return fmt.Errorf("unknown command: %s (try `help`)", fields[0])
+	}
+}
+
+// monitorAsm assembles the instruction in line and executes the resulting
+// words. We do not fetch such words from memory, so the PC does not change
+// unless the instruction itself modifies it. For this reason, we refuse data
+// words and branches and jumps, whose targets only make sense for code that
+// is in memory. Since this includes the calls of pseudo-instructions using
+// runtime routines (e.g., `mul`), you should write such code into memory
+// and use `step` instead. We allow `halt` and `trap`, which do not jump.
+func monitorAsm(machine *vm.VM, line string, w io.Writer) error {
+	var (
+		err   error
+		words []uint32
+	)
+	// Keep reading after the first error, so that the assembler
+	// goroutine does not block forever writing into the channel.
+	for instr := range asm.StartAssembler(strings.NewReader(line)) {
+		switch {
+		case err != nil:
+			// drain the channel
+		case instr.Error != nil:
+			err = instr.Error
+		case instr.Data:
+			err = errors.New("asm: cannot execute data words")
+		case isJump(instr.Instruction):
+			err = fmt.Errorf("asm: cannot execute %q outside of memory (use step)",
+				vm.Disassemble(instr.Instruction))
+		default:
+			words = append(words, instr.Instruction)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, ci := range words {
+		fmt.Fprintf(w, "0x%08x  %s\n", ci, vm.Disassemble(ci))
+		if err := machine.Execute(ci); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isJump returns whether ci is a branch or a jump. We do not consider
+// `jalr r0 r0 imm` (i.e., halt or trap) to be a jump.
+func isJump(ci uint32) bool {
+	switch vm.DecodeOpcode(ci) {
+	case vm.OpcodeBEQ:
+		return true
+	case vm.OpcodeJALR:
+		return vm.DecodeRA(ci) != 0 || vm.DecodeRB(ci) != 0
+	default:
+		return false
+	}
+}
+
+// monitorMem prints words of physical memory.
+func monitorMem(machine *vm.VM, args []string, w io.Writer) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: mem <addr> [count]")
+	}
+	addr, err := strconv.ParseUint(args[0], 0, 32)
+	if err != nil {
+		return err
+	}
+	count := uint64(1)
+	if len(args) > 1 {
+		if count, err = strconv.ParseUint(args[1], 0, 32); err != nil {
+			return err
+		}
+	}
+	for ; count > 0; count, addr = count-1, addr+1 {
+		ci, err := machine.ReadMem(uint32(addr))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "0x%08x: 0x%08x  %s\n", addr, ci, vm.DisassembleAt(ci, uint32(addr), nil))
+	}
+	return nil
+}
+
+// monitorSet sets a register or a word of physical memory.
+func monitorSet(machine *vm.VM, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: set <rN|addr> <value>")
+	}
+	value, err := strconv.ParseInt(args[1], 0, 64)
+	if err != nil {
+		return err
+	}
+	if value < math.MinInt32 || value > math.MaxUint32 {
+		return fmt.Errorf("set: value %s does not fit into 32 bits", args[1])
+	}
+	if strings.HasPrefix(args[0], "r") {
+		reg, err := strconv.ParseUint(args[0][1:], 10, 32)
+		if err != nil {
+			return err
+		}
+		return machine.SetReg(uint32(reg), uint32(value))
+	}
+	addr, err := strconv.ParseUint(args[0], 0, 32)
+	if err != nil {
+		return err
+	}
+	return machine.WriteMem(uint32(addr), uint32(value))
+}
+
+// monitorStep executes count instructions, or runs until the VM halts
+// or faults when count is negative.
+func monitorStep(machine *vm.VM, count int64, w io.Writer) error {
+	for ; count != 0; count-- {
+		pc := machine.PC
+		ci, err := machine.Step()
+		var fault *vm.FaultError
+		if count > 0 && !(errors.As(err, &fault) && fault.Fetch) {
+			fmt.Fprintf(w, "0x%08x: 0x%08x  %s\n", pc, ci, vm.DisassembleAt(ci, pc, nil))
+		}
+		if err != nil {
+			if errors.Is(err, vm.ErrHalted) {
+				fmt.Fprintln(w, err.Error())
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/risc32/pkg/asm"
+	"github.com/bassosimone/risc32/pkg/vm"
+)
+
+// runMonitor runs the monitor on machine using script as input
+// and returns the output of the monitor.
+func runMonitor(t *testing.T, machine *vm.VM, script string) string {
+	var out bytes.Buffer
+	if err := monitor(machine, strings.NewReader(script), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+// loadProgram assembles source and loads it into a new VM.
+func loadProgram(t *testing.T, source string) *vm.VM {
+	var words []uint32
+	for instr := range asm.StartAssembler(strings.NewReader(source)) {
+		if instr.Error != nil {
+			t.Fatal(instr.Error)
+		}
+		words = append(words, instr.Instruction)
+	}
+	machine, err := vm.LoadWords(words)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return machine
+}
+
+func TestMonitorAsmStraightLine(t *testing.T) {
+	machine := vm.NewVM(0)
+	out := runMonitor(t, machine, strings.Join([]string{
+		"asm addi r3 r0 5",
+		"asm movi r4 0x12345",
+		"set r6 7",
+		"reg -v",
+		"quit",
+	}, "\n"))
+	if machine.GPR[3] != 5 || machine.GPR[4] != 0x12345 || machine.GPR[6] != 7 {
+		t.Fatalf("unexpected registers: %+v\n%s", machine.GPR, out)
+	}
+	if machine.PC != 0 {
+		t.Fatalf("asm changed the PC to 0x%08x", machine.PC)
+	}
+	if !strings.Contains(out, "0x10c00005  addi r3 r0 5") {
+		t.Fatalf("missing disassembly in output:\n%s", out)
+	}
+}
+
+func TestMonitorAsmRefusesJumps(t *testing.T) {
+	for _, line := range []string{
+		"asm mul r5 r3 r4", // calls a runtime routine
+		"asm beq r0 r0 0",
+		"asm jalr r31 r1",
+		"asm .fill 7",
+	} {
+		machine := vm.NewVM(0)
+		machine.GPR[3], machine.GPR[4], machine.GPR[29] = 5, 6, 0x8000
+		out := runMonitor(t, machine, line+"\nquit\n")
+		if !strings.Contains(out, "error: asm: cannot execute") {
+			t.Fatalf("%s: expected an error, got:\n%s", line, out)
+		}
+		if machine.PC != 0 || machine.GPR[5] != 0 || machine.GPR[31] != 0 {
+			t.Fatalf("%s: the VM state has changed: PC=0x%08x GPR=%+v",
+				line, machine.PC, machine.GPR)
+		}
+	}
+}
+
+func TestMonitorStepAndContinue(t *testing.T) {
+	machine := loadProgram(t, strings.Join([]string{
+		"addi r3 r0 5",
+		"addi r4 r0 6",
+		"mul r5 r3 r4",
+		"halt",
+	}, "\n"))
+	machine.GPR[29] = 0x8000
+	out := runMonitor(t, machine, strings.Join([]string{
+		"step 2",
+		"mem 0 2",
+		"continue",
+		"reg",
+		"quit",
+	}, "\n"))
+	for _, expect := range []string{
+		"0x00000000: 0x10c00005  addi r3 r0 5",
+		"0x00000001: 0x11000006  addi r4 r0 6",
+		"vm: halted: halt",
+		"r5 : 0x0000001e",
+	} {
+		if !strings.Contains(out, expect) {
+			t.Fatalf("missing %q in output:\n%s", expect, out)
+		}
+	}
+	if machine.GPR[5] != 30 {
+		t.Fatalf("expected r5 to be 30, got %d", machine.GPR[5])
+	}
+}
+
+func TestMonitorUnknownCommand(t *testing.T) {
+	out := runMonitor(t, vm.NewVM(0), "frobnicate\n")
+	if !strings.Contains(out, "error: unknown command: frobnicate") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+}
+
+func TestMonitorAsmDoesNotLeakGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	script := strings.Repeat("asm mul r5 r3 r4\nasm beq r0 r0 0\nasm addi r1 r0 1 2\n", 10)
+	runMonitor(t, vm.NewVM(0), script)
+	// the assembler goroutines may take a while to exit
+	for idx := 0; idx < 100 && runtime.NumGoroutine() > before; idx++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("leaked %d goroutines", after-before)
+	}
+}
+
+func TestMonitorSetRange(t *testing.T) {
+	machine := vm.NewVM(0)
+	out := runMonitor(t, machine, strings.Join([]string{
+		"set r1 0x1_0000_0000",
+		"set r2 -2147483649",
+		"set r3 0xffffffff",
+		"set r4 -1",
+		"set 16 -2147483648",
+	}, "\n"))
+	if strings.Count(out, "does not fit into 32 bits") != 2 {
+		t.Fatalf("expected two errors, got:\n%s", out)
+	}
+	if machine.GPR[1] != 0 || machine.GPR[2] != 0 {
+		t.Fatalf("out of range values have been stored: %+v", machine.GPR)
+	}
+	if machine.GPR[3] != 0xffffffff || machine.GPR[4] != 0xffffffff {
+		t.Fatalf("unexpected registers: %+v", machine.GPR)
+	}
+	if word, _ := machine.ReadMem(16); word != 0x80000000 {
+		t.Fatalf("unexpected memory word: 0x%08x", word)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/bassosimone/risc32/pkg/vm"
+)
+
+func main() {
+	log.SetFlags(0)
+	datamap := flag.String("datamap", "", "optional file listing the ranges containing data")
+	filename := flag.String("f", "", "file to verify")
+	verbose := flag.Bool("v", false, "be verbose")
+	flag.Parse()
+	if *filename == "" {
+		log.Fatal("usage: verify [-datamap <data-map-file>] [-v] -f <machine-code-file>")
+	}
+	fp, err := os.Open(*filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fp.Close()
+	words, err := vm.ReadBytecode(fp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var data vm.DataRanges
+	if *datamap != "" {
+		dfp, err := os.Open(*datamap)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer dfp.Close()
+		data, err = vm.ReadDataRanges(dfp)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := vm.VerifyWithData(words, data); err != nil {
+		log.Fatal(err)
+	}
+	if *verbose {
+		log.Printf("verify: %d words: ok", len(words))
+	}
+}
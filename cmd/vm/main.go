@@ -1,51 +1,66 @@
 package main
 
 import (
-	"errors"
 	"flag"
-	"fmt"
 	"log"
 	"os"
+	"strconv"
 
+	"github.com/bassosimone/risc32/internal/cmdutil"
 	"github.com/bassosimone/risc32/pkg/vm"
 )
 
 func main() {
 	log.SetFlags(0)
+	base := flag.Uint("base", 0, "address where to load the machine code")
+	coredump := flag.String("coredump", "", "optional file where to write a core dump when the VM stops")
 	debug := flag.Bool("d", false, "enable debugging")
+	var data cmdutil.DataFlag
+	flag.Var(&data, "data", "load the content of file at addr (addr=file, may be repeated)")
+	disk := flag.String("disk", "", "optional file to use as disk")
+	entry := flag.String("entry", "", "optional address of the first instruction to execute")
 	filename := flag.String("f", "", "file to run")
+	lenient := flag.Bool("lenient", false, "ignore instructions with unknown opcodes")
+	memsize := flag.Uint("memsize", vm.MemorySize, "memory size in words")
+	timeout := flag.Duration("timeout", 0, "optional maximum running time (e.g., 10s)")
 	verbose := flag.Bool("v", false, "be verbose")
 	flag.Parse()
 	if *filename == "" {
-		log.Fatal("usage: vm [-d] [-v] -f <machine-code-file>")
+		log.Fatal("usage: vm [-base <addr>] [-coredump <file>] [-d] [-data <addr=file>] [-disk <file>] [-entry <addr>] [-lenient] [-memsize <words>] [-timeout <duration>] [-v] -f <machine-code-file>")
 	}
 	fp, err := os.Open(*filename)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer fp.Close()
-	machine, err := vm.LoadBytecode(fp)
-	if err != nil {
+	machine := vm.NewVM(uint32(*memsize))
+	if err := machine.LoadBytecode(fp, uint32(*base)); err != nil {
+		log.Fatal(err)
+	}
+	if err := cmdutil.LoadData(machine, data); err != nil {
 		log.Fatal(err)
 	}
-	for {
-		ci, err := machine.Fetch()
+	if *entry != "" {
+		value, err := strconv.ParseUint(*entry, 0, 32)
 		if err != nil {
 			log.Fatal(err)
 		}
-		if *verbose {
-			log.Printf("vm: %s", machine)
-			log.Printf("vm: %#032b %s\n", ci, vm.Disassemble(ci))
-		}
-		if *debug {
-			log.Printf("vm: paused...")
-			fmt.Scanln()
-		}
-		if err := machine.Execute(ci); err != nil {
-			if errors.Is(err, vm.ErrHalted) {
-				break
-			}
+		machine.PC = uint32(value)
+	}
+	if *disk != "" {
+		fdisk, err := vm.OpenFileDisk(*disk)
+		if err != nil {
 			log.Fatal(err)
 		}
+		defer fdisk.Close()
+		machine.Disk = fdisk
+	}
+	machine.LenientOpcodes = *lenient
+	machine.Tracer = cmdutil.Debugger{
+		Debug:   *debug,
+		Verbose: *verbose,
+	}
+	if err := cmdutil.Run(machine, *timeout, *coredump); err != nil {
+		log.Fatal(err)
 	}
 }
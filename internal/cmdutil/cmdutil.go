@@ -0,0 +1,139 @@
+// Package cmdutil contains code shared by the commands running the VM.
+package cmdutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bassosimone/risc32/pkg/vm"
+)
+
+// DataFlag is the -data flag. Each value has the addr=file form.
+type DataFlag []string
+
+// String implements flag.Value.String.
+func (df *DataFlag) String() string {
+	return strings.Join(*df, ",")
+}
+
+// Set implements flag.Value.Set.
+func (df *DataFlag) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("expected addr=file")
+	}
+	*df = append(*df, value)
+	return nil
+}
+
+// LoadData loads the data files specified using the -data flag.
+func LoadData(machine *vm.VM, df DataFlag) error {
+	for _, value := range df {
+		v := strings.SplitN(value, "=", 2)
+		addr, err := strconv.ParseUint(v[0], 0, 32)
+		if err != nil {
+			return err
+		}
+		fp, err := os.Open(v[1])
+		if err != nil {
+			return err
+		}
+		err = machine.LoadData(fp, uint32(addr))
+		fp.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteCore writes the core dump of machine into filename, unless
+// filename is empty. See the documentation of vm.WriteCore.
+func WriteCore(machine *vm.VM, filename string) {
+	if filename == "" {
+		return
+	}
+	fp, err := os.Create(filename)
+	if err == nil {
+		err = machine.WriteCore(fp)
+		if cerr := fp.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Printf("vm: cannot write core dump: %s", err.Error())
+	}
+}
+
+// Run runs machine using vm.RunContext until the VM halts or faults or,
+// when timeout is positive, until the timeout expires. In all cases, it
+// then writes the core dump of machine into coredump (see WriteCore). This
+// function returns nil when the VM halts and an error otherwise.
+func Run(machine *vm.VM, timeout time.Duration, coredump string) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := machine.RunContext(ctx)
+	WriteCore(machine, coredump)
+	if err != nil && errors.Is(err, ctx.Err()) {
+		return fmt.Errorf("vm: stopped after %s: %w", timeout, err)
+	}
+	return err
+}
+
+// Debugger is a vm.Tracer implementing the -d and -v flags of the
+// commands running the VM. Set it as the Tracer of the VM before Run.
+type Debugger struct {
+	Debug   bool // pause before each instruction and interrupt (-d)
+	Status  bool // also honor the debug flags of S[0]
+	Verbose bool // print the VM state before each instruction (-v)
+}
+
+// stepping returns whether we should pause.
+func (d Debugger) stepping(machine *vm.VM) bool {
+	return d.Debug || (d.Status && (machine.StatusDebug()&vm.StatusDebugStepping) != 0)
+}
+
+// BeforeExecute implements vm.Tracer.BeforeExecute.
+func (d Debugger) BeforeExecute(machine *vm.VM, ci uint32) {
+	if d.Verbose || (d.Status && (machine.StatusDebug()&vm.StatusDebugTracing) != 0) {
+		log.Printf("vm: %s", machine)
+		log.Printf("vm: %#032b %s\n", ci, vm.Disassemble(ci))
+		log.Printf("vm: S[3]: %d", machine.S[3])
+		log.Printf("vm: stack (r29): %d", machine.GPR[29])
+	}
+	if d.stepping(machine) {
+		log.Printf("vm: paused...")
+		fmt.Scanln()
+	}
+}
+
+// AfterExecute implements vm.Tracer.AfterExecute.
+func (d Debugger) AfterExecute(machine *vm.VM, ci uint32, err error) {
+	if d.Verbose && errors.Is(err, vm.ErrHalted) {
+		log.Print(err)
+	}
+}
+
+// BeforeInterrupt implements vm.InterruptTracer.BeforeInterrupt. We
+// pause before entering the interrupt handler, so that one can step
+// into the handler.
+func (d Debugger) BeforeInterrupt(machine *vm.VM, code uint32) {
+	if d.stepping(machine) {
+		log.Printf("vm: irq %d: paused before entering the handler...", code)
+		fmt.Scanln()
+	}
+}
+
+var (
+	_ vm.Tracer          = Debugger{}
+	_ vm.InterruptTracer = Debugger{}
+)
@@ -0,0 +1,126 @@
+package cmdutil
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/risc32/pkg/asm"
+	"github.com/bassosimone/risc32/pkg/vm"
+)
+
+// newMachine assembles source and loads it into a new VM with
+// the given memory size and with poisoned memory.
+func newMachine(t *testing.T, memWords uint32, source string) *vm.VM {
+	var words []uint32
+	for instr := range asm.StartAssembler(strings.NewReader(source)) {
+		if instr.Error != nil {
+			t.Fatal(instr.Error)
+		}
+		words = append(words, instr.Instruction)
+	}
+	machine := vm.NewVM(memWords)
+	machine.PoisonMemory = true
+	if err := machine.Load(words, 0); err != nil {
+		t.Fatal(err)
+	}
+	return machine
+}
+
+func TestWriteCoreAfterFault(t *testing.T) {
+	machine := newMachine(t, 2048, strings.Join([]string{
+		"addi r1 r0 5",
+		"sw r1 r0 100",
+		"lw r2 r0 4096", // above physical memory
+		"halt",
+	}, "\n"))
+	var fault *vm.FaultError
+	if err := machine.Run(); !errors.As(err, &fault) {
+		t.Fatalf("expected a fault, got %v", err)
+	}
+	dir, err := ioutil.TempDir("", "risc32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "core")
+	WriteCore(machine, filename)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// entry, state, and words up to the one written by sw
+	if lines := strings.Count(string(data), "\n"); lines != 103 {
+		t.Fatalf("expected 103 lines, got %d", lines)
+	}
+	fp, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	loaded, err := vm.LoadCore(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.State(), machine.State()) {
+		t.Fatalf("state mismatch: %+v != %+v", loaded.State(), machine.State())
+	}
+	if !reflect.DeepEqual(loaded.PhysicalMemory(), machine.PhysicalMemory()) {
+		t.Fatal("memory mismatch")
+	}
+	if loaded.MemoryWords() != 2048 {
+		t.Fatalf("expected 2048 words of memory, got %d", loaded.MemoryWords())
+	}
+}
+
+func TestWriteCoreWithEmptyFilename(t *testing.T) {
+	WriteCore(vm.NewVM(0), "") // must not create any file
+}
+
+func TestDataFlag(t *testing.T) {
+	var df DataFlag
+	if err := df.Set("0x10"); err == nil {
+		t.Fatal("expected an error without the file name")
+	}
+	if err := df.Set("0x10=a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := df.Set("0x20=b.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if s := df.String(); s != "0x10=a.bin,0x20=b.bin" {
+		t.Fatalf("unexpected value: %s", s)
+	}
+}
+
+func TestRunStopsSpinLoopAfterTimeout(t *testing.T) {
+	machine := newMachine(t, 1024, "loop: beq r0 r0 loop")
+	const timeout = 100 * time.Millisecond
+	start := time.Now()
+	err := Run(machine, timeout, "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 20*timeout {
+		t.Fatalf("Run took %s to stop", elapsed)
+	}
+	if !strings.Contains(err.Error(), "stopped after 100ms") {
+		t.Fatalf("unexpected error message: %s", err)
+	}
+}
+
+func TestRunReturnsNilWhenHalting(t *testing.T) {
+	machine := newMachine(t, 1024, "addi r1 r0 1\nhalt")
+	if err := Run(machine, time.Minute, ""); err != nil {
+		t.Fatal(err)
+	}
+	if machine.GPR[1] != 1 {
+		t.Fatalf("expected r1 to be 1, got %d", machine.GPR[1])
+	}
+}
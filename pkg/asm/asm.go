@@ -2,20 +2,125 @@
 //
 // See the documentation of the vm package for more information
 // about the instruction set and the bytecode format.
+//
+// Labels
+//
+// Each line contains an optional label followed by a colon, an optional
+// instruction or directive, and an optional comment starting with `#`. A
+// label on a line without instruction refers to the next instruction:
+//
+//     loop:           # increment r1 forever
+//         addi r1 r1 1
+//         beq r0 r0 loop
+//
+// Register conventions
+//
+// Some pseudo-instructions expand to several native instructions and
+// need registers to do that. By convention, r1 is the assembler temporary
+// register, which such pseudo-instructions may clobber, and r31 is the
+// link register, which holds the return address of a subroutine call. For
+// example, `call label` expands to:
+//
+//     lui r1 label
+//     addi r1 r1 (label & 0x3ff)
+//     jalr r31 r1
+//
+// while `ret` expands to `jalr r0 r31`. Likewise, `jal rA label` uses r1
+// to hold the address of label and saves the return address into rA, which
+// therefore cannot be r1. You can also refer to registers
+// using MIPS-like aliases (see RegisterAliases), e.g., `$sp` for r29.
+//
+// Immediates
+//
+// Immediate values are decimal (e.g., `42`), hexadecimal (e.g., `0x2a`),
+// or binary (e.g., `0b101010`) numbers with an optional leading minus
+// sign (e.g., `-0x10`), or character literals (e.g., `'A'` or `'\n'`),
+// whose value is the character code. A value must fit the instruction
+// field as a signed number (e.g., 17 bits for ADDI and BEQ), except that
+// 32-bit values, used by .fill, LUI, and MOVI, may also be unsigned (e.g.,
+// `0xffffffff`). Note that LUI only loads the upper 22 bits of its value,
+// thus the assembler warns when LUI would discard nonzero low 10 bits
+// (e.g., `lui r1 0x3ff`), since you probably meant to use MOVI. The
+// `li rA imm` pseudo-instruction picks the shortest encoding: it becomes
+// `addi rA r0 imm` when imm is a number fitting 17 bits and MOVI otherwise.
+//
+// Constants
+//
+// The `.equ NAME value` directive defines a named constant, which can be
+// used wherever an immediate is expected. The value may be a number or
+// the name of an already defined label or constant. The assembler also
+// predefines the constants of the ISA (see PredefinedConstants), e.g.:
+//
+//     addi r8 r0 StatusInterrupts
+//     movi r9 MMTTYOut
+//
+// Reserving memory
+//
+// The `.space count` directive reserves count zero words, while the
+// `.bss NAME count` directive also binds NAME to the address of the first
+// reserved word, which is clearer for naming uninitialized data regions,
+// such as stacks and page tables:
+//
+//     .bss kstack 1024
+//     .bss buffer 16   # buffer is kstack+1024
+//
+// Including files
+//
+// The `.include "path"` directive replaces itself with the content of the
+// file at path, which is relative to the directory of the including file
+// or, for the main file, to the directory passed to
+// StartAssemblerWithBaseDir. Errors mention the included file name.
+//
+// Conditional assembly
+//
+// The lines between `.if EXPR` and the matching `.else` (or `.endif`) are
+// only assembled when EXPR is not zero, while the lines between `.else`
+// and `.endif` are only assembled when EXPR is zero. EXPR is a number or
+// a label or constant defined before the `.if`. Conditional blocks nest,
+// must end in the same file where they begin, and cannot have labels:
+//
+//     .equ DEBUG 1
+//     .if DEBUG
+//       addi r1 r0 1
+//     .else
+//       addi r1 r0 0
+//     .endif
+//
+// Optimizer
+//
+// When Config.Optimize is true, the assembler runs a peephole optimizer
+// before encoding, which removes instructions that do not change the
+// state of the VM, e.g., `nop`, `addi rA rA 0`, or `mov rB rA` following
+// `mov rA rB`. Labels referring to removed instructions refer to the next
+// kept instruction. Because the optimizer moves instructions, the program
+// must refer to them using labels rather than numeric addresses.
 package asm
 
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bassosimone/risc32/pkg/spec"
 )
 
 // InstructionOrError contains either an assembled instruction
 // or an error that occurred during the assemblation.
 type InstructionOrError struct {
+	Address     uint32 // address of the instruction
+	Data        bool   // whether this is a data word (e.g., .fill, .space)
+	Entry       bool   // whether this instruction is the entry point
 	Instruction uint32
 	Error       error
+	File        string // file containing the instruction, if not the main file
+	Label       string // label attached to the instruction, if any
 	Lineno      int
+	Text        string // source code of the instruction
+	Warning     error  // possible issue with a valid instruction
 }
 
 // Encode encodes the current instruction or returns an error.
@@ -28,42 +133,572 @@ func (ioe InstructionOrError) Encode() (string, error) {
 	), nil
 }
 
+// Listing returns the line of the assembler listing describing the current
+// instruction, located at addr, or an error. The line contains the address,
+// the encoded instruction, and the source code of the instruction, e.g.:
+//
+//     0x00000003: 0x10400005  ; addi r1 r0 5
+//
+// Each word generated by a pseudo-instruction has its own line.
+func (ioe InstructionOrError) Listing(addr uint32) (string, error) {
+	if ioe.Error != nil {
+		return "", ioe.Error
+	}
+	return fmt.Sprintf("0x%08x: 0x%08x  ; %s\n", addr, ioe.Instruction, ioe.Text), nil
+}
+
+// GoSource returns Go source code declaring the name variable initialized
+// with the words of an assembled program, e.g.:
+//
+//     var program = []uint32{
+//     	0x10400005, 0x00000000,
+//     }
+//
+// This allows embedding programs into Go code and loading them
+// into a VM using vm.LoadWords.
+func GoSource(name string, words []uint32) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "var %s = []uint32{\n", name)
+	for idx, word := range words {
+		switch {
+		case idx%4 == 0:
+			b.WriteString("\t")
+		default:
+			b.WriteString(" ")
+		}
+		fmt.Fprintf(&b, "0x%08x,", word)
+		if idx%4 == 3 || idx == len(words)-1 {
+			b.WriteString("\n")
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
 // StartAssembler starts the assembler in a background goroutine an
 // returns a sequence of InstructionOrError.
 func StartAssembler(r io.Reader) <-chan InstructionOrError {
+	return StartAssemblerWithBaseDir(r, ".")
+}
+
+// StartAssemblerWithBaseDir is like StartAssembler except that we resolve
+// the paths of the included files relative to the dir directory.
+func StartAssemblerWithBaseDir(r io.Reader, dir string) <-chan InstructionOrError {
+	return StartAssemblerWithConfig(r, Config{BaseDir: dir})
+}
+
+// StartAssemblerWithConfig is like StartAssembler except that
+// it uses the given configuration.
+func StartAssemblerWithConfig(r io.Reader, config Config) <-chan InstructionOrError {
 	out := make(chan InstructionOrError)
-	go AssemblerAsync(r, out)
+	go AssemblerAsyncWithConfig(r, config, out)
 	return out
 }
 
+// DefaultMaxErrors is the default maximum number of errors that
+// we report when parsing before giving up.
+const DefaultMaxErrors = 10
+
+// Config contains the configuration of the assembler.
+type Config struct {
+	// BaseDir is the directory relative to which we resolve the
+	// paths of the included files. If empty, we use ".".
+	BaseDir string
+
+	// MaxErrors is the maximum number of errors that we report when
+	// parsing. When a line contains an error, we report it and continue
+	// parsing from the next line, so that the user can fix several errors
+	// at once. If zero, we use DefaultMaxErrors. Set it to one to stop
+	// at the first error, which may be handy when scripting.
+	MaxErrors int
+
+	// MemorySize is the size, in words, of the memory of the VM that
+	// will run the program. We fail with ErrProgramTooLarge when the
+	// program does not fit. If zero, we use spec.MemorySize.
+	MemorySize int
+
+	// Optimize enables the peephole optimizer (see the documentation
+	// of the package for more information).
+	Optimize bool
+}
+
+// ParseAndAppend parses the assembly code read from r, appends the
+// resulting instructions to instructions, and records the address of each
+// label and constant into labels. On failure, it returns the error to report.
+func ParseAndAppend(r io.Reader, labels map[string]int64,
+	instructions []Instruction) ([]Instruction, *InstructionOrError) {
+	a := &assembler{
+		addresses:    make(map[string]bool),
+		instructions: instructions,
+		labels:       labels,
+		maxErrors:    1,
+		sources:      make(map[string][]string),
+		symbols:      make(map[int64]string),
+	}
+	if a.parse(r, "", ".", nil); len(a.failures) > 0 {
+		return nil, &a.failures[0]
+	}
+	return a.instructions, nil
+}
+
+// assembler contains the state of the assembler.
+type assembler struct {
+	addresses    map[string]bool      // labels and constants defined as labels
+	aligns       []alignment          // padding added by .align
+	failures     []InstructionOrError // errors occurred when parsing
+	instructions []Instruction
+	labels       map[string]int64
+	maxErrors    int                 // stop parsing after this many failures
+	sources      map[string][]string // lines of each source file
+	symbols      map[int64]string    // label of each address, if any
+	entry        *InstructionENTRY   // entry point, if any
+	entryFile    string              // file containing the entry point
+}
+
+// label records that name labels the address addr.
+func (a *assembler) label(name string, addr int64) {
+	a.addresses[name] = true
+	a.labels[name] = addr
+	a.symbols[addr] = name
+}
+
+// failure returns the InstructionOrError reporting that err occurred on
+// the lineno line of file (where the empty string means the main file). We
+// include the file name, if needed, and the text of the line.
+func (a *assembler) failure(err error, file string, lineno int) InstructionOrError {
+	if text := a.text(file, lineno); text != "" {
+		err = fmt.Errorf("%w: %q", err, text)
+	}
+	if file != "" {
+		err = fmt.Errorf("%s: %w", file, err)
+	}
+	return InstructionOrError{Error: err, File: file, Lineno: lineno}
+}
+
+// text returns the text of the lineno line of file, without leading and
+// trailing spaces, or an empty string if there is no such line.
+func (a *assembler) text(file string, lineno int) string {
+	if lines := a.sources[file]; lineno >= 1 && lineno <= len(lines) {
+		return strings.TrimSpace(lines[lineno-1])
+	}
+	return ""
+}
+
+// parse parses the assembly code read from r, appends the resulting
+// instructions, and records the address of each label and constant. When
+// a line contains an error, we record the failure and skip to the next
+// line, unless we have already recorded maxErrors failures, in which case
+// we stop parsing. The file argument is the name of the file we're reading
+// from, or the empty string for the main file, and dir is the directory
+// relative to which we resolve included files. The stack contains the
+// paths of the files that we are currently including, which allows us to
+// detect cycles.
+//
+// We lex and parse one line at a time, because we need to know the value
+// of the constants defined so far to decide whether to skip a line that
+// is inside a conditional block (see the .if directive).
+func (a *assembler) parse(r io.Reader, file, dir string, stack []string) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		a.failures = append(a.failures, InstructionOrError{Error: err})
+		return
+	}
+	a.sources[file] = strings.Split(string(data), "\n")
+	var conds []conditional
+	for idx, text := range a.sources[file] {
+		if a.stopped() {
+			return
+		}
+		tokens := lexLine(strings.TrimSuffix(text, "\r"), idx+1)
+		if len(conds) > 0 && !conds[len(conds)-1].active && !isConditional(tokens) {
+			continue // skip lines inside inactive conditional blocks
+		}
+		for _, instr := range ParseAssemblyInstruction(feed(tokens)) {
+			if failure := a.process(instr, file, dir, stack, &conds); failure != nil {
+				a.failures = append(a.failures, *failure)
+				break // resynchronize at the next line
+			}
+		}
+	}
+	if len(conds) > 0 && !a.stopped() {
+		lineno := conds[len(conds)-1].lineno
+		a.failures = append(a.failures, a.failure(fmt.Errorf(
+			"%w: .if on line %d lacks .endif", ErrConditional, lineno), file, lineno))
+	}
+}
+
+// stopped returns whether we have recorded enough failures to stop parsing.
+func (a *assembler) stopped() bool {
+	return len(a.failures) >= a.maxErrors
+}
+
+// conditional is a conditional block started by the .if directive.
+type conditional struct {
+	active   bool // whether the current branch is active
+	lineno   int  // line of the .if directive
+	outer    bool // whether the outer block is active
+	seenElse bool // whether we have seen the .else directive
+	value    bool // value of the .if condition
+}
+
+// lexLine returns the tokens of the given line of source code.
+func lexLine(text string, lineno int) []LexerToken {
+	ch := make(chan LexerToken, len(text)+2) // enough for any line
+	LexLine(text, lineno, ch)
+	close(ch)
+	var tokens []LexerToken
+	for token := range ch {
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// feed returns a closed channel from which one can read tokens.
+func feed(tokens []LexerToken) <-chan LexerToken {
+	ch := make(chan LexerToken, len(tokens))
+	for _, token := range tokens {
+		ch <- token
+	}
+	close(ch)
+	return ch
+}
+
+// isConditional returns whether tokens contain a conditional directive,
+// possibly preceded by a label.
+func isConditional(tokens []LexerToken) bool {
+	for idx := 0; idx < len(tokens) && idx < 2; idx++ {
+		if tokens[idx].Type != LexerNameOrNumber {
+			continue // skip the colon after the label
+		}
+		switch tokens[idx].Value {
+		case ".if", ".else", ".endif":
+			return true
+		}
+	}
+	return false
+}
+
+// process processes instr, which comes from the file that we're parsing
+// and possibly modifies the stack of conditional blocks. See parse for the
+// meaning of the other arguments.
+func (a *assembler) process(instr Instruction, file, dir string, stack []string,
+	conds *[]conditional) *InstructionOrError {
+	if instr.Err() != nil {
+		failure := a.failure(instr.Err(), file, instr.Line())
+		return &failure
+	}
+	if cond, ok := instr.(InstructionCOND); ok {
+		return a.conditional(cond, file, conds)
+	}
+	idx := int64(len(a.instructions))
+	if align, ok := instr.(InstructionALIGN); ok {
+		start := idx
+		for idx%(1<<align.Bits) != 0 {
+			a.append(InstructionDATA{Lineno: align.Lineno}, file)
+			idx++
+		}
+		a.aligns = append(a.aligns, alignment{
+			bits: align.Bits, end: idx, file: file, lineno: align.Lineno, start: start})
+		if align.Label() != nil {
+			a.label(*align.Label(), idx) // the aligned address
+		}
+		return nil
+	}
+	if instr.Label() != nil {
+		a.label(*instr.Label(), idx)
+	}
+	if _, ok := instr.(InstructionLABEL); ok {
+		return nil // the label refers to the next instruction
+	}
+	if equ, ok := instr.(InstructionEQU); ok {
+		if _, found := a.labels[equ.Name]; found {
+			failure := a.failure(fmt.Errorf("%w: '%s' on line %d",
+				ErrRedefined, equ.Name, equ.Lineno), file, equ.Lineno)
+			return &failure
+		}
+		value, err := equ.Value(a.labels)
+		if err != nil {
+			failure := a.failure(err, file, equ.Lineno)
+			return &failure
+		}
+		a.labels[equ.Name] = value
+		if a.addresses[equ.Imm] {
+			a.addresses[equ.Name] = true // the constant is an address
+		}
+		return nil // constants do not occupy memory
+	}
+	if bss, ok := instr.(InstructionBSS); ok {
+		if _, found := a.labels[bss.Name]; found {
+			failure := a.failure(fmt.Errorf("%w: '%s' on line %d",
+				ErrRedefined, bss.Name, bss.Lineno), file, bss.Lineno)
+			return &failure
+		}
+		a.label(bss.Name, idx)
+		for i := uint32(0); i < bss.Count; i++ {
+			a.append(InstructionDATA{Lineno: bss.Lineno}, file)
+		}
+		return nil
+	}
+	if entry, ok := instr.(InstructionENTRY); ok {
+		if a.entry != nil {
+			failure := a.failure(fmt.Errorf("%w: .entry on line %d",
+				ErrMultipleEntries, entry.Lineno), file, entry.Lineno)
+			return &failure
+		}
+		a.entry, a.entryFile = &entry, file
+		return nil
+	}
+	if inc, ok := instr.(InstructionINCLUDE); ok {
+		return a.include(inc, file, dir, stack)
+	}
+	a.append(instr, file)
+	return nil
+}
+
+// conditional updates the stack of conditional blocks of file
+// according to the cond directive.
+func (a *assembler) conditional(
+	cond InstructionCOND, file string, conds *[]conditional) *InstructionOrError {
+	fail := func(reason string) *InstructionOrError {
+		failure := a.failure(fmt.Errorf("%w: %s on line %d",
+			ErrConditional, reason, cond.Lineno), file, cond.Lineno)
+		return &failure
+	}
+	if cond.Label() != nil {
+		return fail("label before " + cond.Directive)
+	}
+	switch cond.Directive {
+	case ".if":
+		outer := len(*conds) <= 0 || (*conds)[len(*conds)-1].active
+		var value bool
+		if outer { // otherwise the condition may reference undefined constants
+			v, err := ResolveConstant(a.labels, cond.Imm, cond.Lineno)
+			if err != nil {
+				// Skip the whole block, so that the matching .else and
+				// .endif do not cause further errors.
+				*conds = append(*conds, conditional{lineno: cond.Lineno})
+				failure := a.failure(err, file, cond.Lineno)
+				return &failure
+			}
+			value = v != 0
+		}
+		*conds = append(*conds, conditional{
+			active: outer && value,
+			lineno: cond.Lineno,
+			outer:  outer,
+			value:  value,
+		})
+	case ".else":
+		if len(*conds) <= 0 {
+			return fail(".else without .if")
+		}
+		top := &(*conds)[len(*conds)-1]
+		if top.seenElse {
+			return fail("duplicate .else")
+		}
+		top.active, top.seenElse = top.outer && !top.value, true
+	case ".endif":
+		if len(*conds) <= 0 {
+			return fail(".endif without .if")
+		}
+		*conds = (*conds)[:len(*conds)-1]
+	}
+	return nil
+}
+
+// report writes the failures occurred when parsing on out. When we have
+// stopped parsing because of too many failures, we also say so.
+func (a *assembler) report(out chan<- InstructionOrError) {
+	for _, failure := range a.failures {
+		out <- failure
+	}
+	if a.maxErrors > 1 && a.stopped() {
+		out <- InstructionOrError{Error: ErrTooManyErrors}
+	}
+}
+
+// append appends instr, which comes from file, to the instructions.
+func (a *assembler) append(instr Instruction, file string) {
+	if file != "" {
+		instr = InstructionIncluded{Instruction: instr, File: file}
+	}
+	a.instructions = append(a.instructions, instr)
+}
+
+// include parses the file included by inc, which appears inside file. See
+// parse for the meaning of the other arguments.
+func (a *assembler) include(
+	inc InstructionINCLUDE, file, dir string, stack []string) *InstructionOrError {
+	path := inc.Path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	for _, entry := range stack {
+		if entry == path {
+			failure := a.failure(fmt.Errorf("%w: '%s' on line %d",
+				ErrIncludeCycle, inc.Path, inc.Lineno), file, inc.Lineno)
+			return &failure
+		}
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		failure := a.failure(fmt.Errorf("asm: cannot include file on line %d: %w",
+			inc.Lineno, err), file, inc.Lineno)
+		return &failure
+	}
+	defer fp.Close()
+	a.parse(fp, path, filepath.Dir(path), append(stack, path))
+	return nil
+}
+
 // AssemblerAsync runs the assembler. It reads from the input reader
 // and it writes InstructionOrError on the output channel.
 func AssemblerAsync(r io.Reader, out chan<- InstructionOrError) {
+	AssemblerAsyncWithBaseDir(r, ".", out)
+}
+
+// AssemblerAsyncWithBaseDir is like AssemblerAsync except that we resolve
+// the paths of the included files relative to the dir directory.
+func AssemblerAsyncWithBaseDir(r io.Reader, dir string, out chan<- InstructionOrError) {
+	AssemblerAsyncWithConfig(r, Config{BaseDir: dir}, out)
+}
+
+// AssemblerAsyncWithConfig is like AssemblerAsync except that
+// it uses the given configuration.
+func AssemblerAsyncWithConfig(r io.Reader, config Config, out chan<- InstructionOrError) {
 	defer close(out)
-	var idx int64
-	labels := make(map[string]int64)
-	var instructions []Instruction
-	for instr := range StartParsing(StartLexing(r)) {
-		if instr.Err() != nil {
-			out <- InstructionOrError{Error: instr.Err(), Lineno: instr.Line()}
-			return
+	if config.BaseDir == "" {
+		config.BaseDir = "."
+	}
+	if config.MaxErrors <= 0 {
+		config.MaxErrors = DefaultMaxErrors
+	}
+	if config.MemorySize <= 0 {
+		config.MemorySize = spec.MemorySize
+	}
+	a := &assembler{
+		addresses: make(map[string]bool),
+		labels:    make(map[string]int64),
+		maxErrors: config.MaxErrors,
+		sources:   make(map[string][]string),
+		symbols:   make(map[int64]string),
+	}
+	if a.parse(r, "", config.BaseDir, nil); len(a.failures) > 0 {
+		a.report(out)
+		return
+	}
+	// Make the predefined constants available, unless the program has
+	// defined labels or constants with the same name.
+	for name, value := range PredefinedConstants {
+		if _, found := a.labels[name]; !found {
+			a.labels[name] = value
 		}
-		if instr.Label() != nil {
-			labels[*instr.Label()] = idx
+	}
+	// Append the runtime routines referenced by the program. Because a
+	// routine may reference other routines, we also scan the instructions
+	// we append, until there are no more routines to link.
+	for idx := 0; idx < len(a.instructions); idx++ {
+		for _, name := range a.instructions[idx].References() {
+			src, found := RuntimeRoutines[name]
+			if _, defined := a.labels[name]; defined || !found {
+				continue
+			}
+			if a.parse(strings.NewReader(src), name, ".", nil); len(a.failures) > 0 {
+				a.report(out)
+				return
+			}
 		}
-		instructions = append(instructions, instr)
-		idx++
 	}
-	for pc, instr := range instructions {
+	if config.Optimize {
+		a.optimize()
+	}
+	// Make sure the program fits into the memory of the VM.
+	if len(a.instructions) > config.MemorySize {
+		out <- InstructionOrError{Error: fmt.Errorf(
+			"%w: %d words exceed the memory size (%d words)",
+			ErrProgramTooLarge, len(a.instructions), config.MemorySize)}
+		return
+	}
+	// Report all the references to undefined labels at once before
+	// encoding, so the user can fix all of them in a single pass. Note
+	// that a pseudo-instruction may expand to several instructions
+	// referencing the same label, so we report each line only once.
+	reported := make(map[string]bool)
+	for _, instr := range a.instructions {
+		var file string
+		if inc, ok := instr.(InstructionIncluded); ok {
+			file = inc.File
+		}
+		for _, name := range instr.References() {
+			key := fmt.Sprintf("%s:%s:%d", file, name, instr.Line())
+			if _, found := a.labels[name]; !found && !reported[key] {
+				out <- a.failure(fmt.Errorf("%w '%s' on line %d",
+					ErrUndefinedLabel, name, instr.Line()), file, instr.Line())
+				reported[key] = true
+			}
+		}
+	}
+	if len(reported) > 0 {
+		return
+	}
+	// Resolve the entry point, if any, which must be inside the program.
+	entry := int64(-1)
+	if a.entry != nil {
+		value, err := ResolveImmediate(a.labels, a.entry.Imm, 32, a.entry.Lineno)
+		if err == nil && int64(value) >= int64(len(a.instructions)) {
+			err = fmt.Errorf("%w: %#x on line %d", ErrBadEntry, value, a.entry.Lineno)
+		}
+		if err != nil {
+			out <- a.failure(err, a.entryFile, a.entry.Lineno)
+			return
+		}
+		entry = int64(value)
+	}
+	for pc, instr := range a.instructions {
 		if pc > math.MaxUint32 {
 			out <- InstructionOrError{Error: ErrTooManyInstructions, Lineno: instr.Line()}
 			return
 		}
-		encoded, err := instr.Encode(labels, uint32(pc))
+		var file string
+		if inc, ok := instr.(InstructionIncluded); ok {
+			file = inc.File
+		}
+		encoded, err := instr.Encode(a.labels, uint32(pc))
 		if err != nil {
-			out <- InstructionOrError{Error: err, Lineno: instr.Line()}
+			out <- a.failure(err, file, instr.Line())
 			continue
 		}
-		out <- InstructionOrError{Instruction: encoded, Lineno: instr.Line()}
+		var warning error
+		if w, ok := unwrapIncluded(instr).(warner); ok {
+			if err := w.Warn(a.labels); err != nil {
+				warning = a.failure(err, file, instr.Line()).Error
+			}
+		}
+		_, data := unwrapIncluded(instr).(InstructionDATA)
+		out <- InstructionOrError{
+			Address:     uint32(pc),
+			Data:        data,
+			Entry:       int64(pc) == entry,
+			File:        file,
+			Instruction: encoded,
+			Label:       a.symbols[int64(pc)],
+			Lineno:      instr.Line(),
+			Text:        a.text(file, instr.Line()),
+			Warning:     warning,
+		}
+	}
+}
+
+// warner is an instruction that could warn about a possible issue.
+type warner interface {
+	Warn(labels map[string]int64) error
+}
+
+// unwrapIncluded returns the instruction wrapped by InstructionIncluded,
+// if instr is such a wrapper, and otherwise instr itself.
+func unwrapIncluded(instr Instruction) Instruction {
+	if inc, ok := instr.(InstructionIncluded); ok {
+		return inc.Instruction
 	}
+	return instr
 }
@@ -0,0 +1,279 @@
+package asm
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/risc32/pkg/spec"
+	"github.com/bassosimone/risc32/pkg/vm"
+)
+
+// assembled is the result of assembling a program.
+type assembled struct {
+	labels map[string]uint32 // address of each label
+	words  []uint32          // machine code
+}
+
+// assembleWithConfig assembles source using config and fails the test
+// if the assembler emits any error.
+func assembleWithConfig(t *testing.T, source string, config Config) assembled {
+	out := assembled{labels: make(map[string]uint32)}
+	for instr := range StartAssemblerWithConfig(strings.NewReader(source), config) {
+		if instr.Error != nil {
+			t.Fatal(instr.Error)
+		}
+		if instr.Label != "" {
+			out.labels[instr.Label] = instr.Address
+		}
+		out.words = append(out.words, instr.Instruction)
+	}
+	return out
+}
+
+// assemble is like assembleWithConfig but uses the default config.
+func assemble(t *testing.T, source string) assembled {
+	return assembleWithConfig(t, source, Config{})
+}
+
+// assembleError assembles source and returns the first error.
+func assembleError(t *testing.T, source string) error {
+	for instr := range StartAssembler(strings.NewReader(source)) {
+		if instr.Error != nil {
+			return instr.Error
+		}
+	}
+	t.Fatal("expected an error")
+	return nil
+}
+
+// lines joins the given lines of assembly code.
+func lines(v ...string) string {
+	return strings.Join(v, "\n") + "\n"
+}
+
+// runWords runs words and returns the final VM.
+func runWords(t *testing.T, words []uint32) *vm.VM {
+	machine, err := vm.LoadWords(words)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return machine
+}
+
+func TestEQU(t *testing.T) {
+	out := assemble(t, lines(
+		"       .equ N 5",
+		"       .equ Port 0x20003",
+		"       .equ Alias N",
+		"start: addi r1 r0 N",
+		"       movi r9 Port",
+		"       addi r2 r0 Alias",
+		"       halt",
+	))
+	if out.labels["start"] != 0 || len(out.words) != 5 {
+		t.Fatalf("constants should not occupy memory: %+v", out)
+	}
+	if out.words[0] != 0x10400005 {
+		t.Fatalf("unexpected encoding: 0x%08x", out.words[0])
+	}
+	machine := runWords(t, out.words)
+	if machine.GPR[9] != 0x20003 || machine.GPR[2] != 5 {
+		t.Fatalf("unexpected values: r9=0x%x r2=%d", machine.GPR[9], machine.GPR[2])
+	}
+}
+
+func TestEQURedefined(t *testing.T) {
+	for _, source := range []string{
+		lines(".equ N 1", ".equ N 2"),
+		lines("N: halt", ".equ N 1"),
+	} {
+		if err := assembleError(t, source); !errors.Is(err, ErrRedefined) {
+			t.Fatalf("%q: expected ErrRedefined, got %v", source, err)
+		}
+	}
+}
+
+func TestPredefinedConstants(t *testing.T) {
+	out := assemble(t, lines(
+		"       .equ IrqTTY 9", // overrides the predefined constant
+		"       addi r8 r0 StatusInterrupts",
+		"       movi r9 MMTTYOut",
+		"       addi r3 r0 IrqTTY",
+		"       addi r4 r0 IrqDisk",
+		"       halt",
+	))
+	if expect := uint32(0x12000000 | spec.StatusInterrupts); out.words[0] != expect {
+		t.Fatalf("expected 0x%08x, got 0x%08x", expect, out.words[0])
+	}
+	machine := runWords(t, out.words)
+	for reg, value := range map[int]uint32{
+		8: spec.StatusInterrupts, 9: spec.MMTTYOut, 3: 9, 4: spec.IrqDisk,
+	} {
+		if machine.GPR[reg] != value {
+			t.Fatalf("r%d: expected 0x%x, got 0x%x", reg, value, machine.GPR[reg])
+		}
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	var table = []struct {
+		source string
+		expect uint32
+	}{
+		{lines(".equ DEBUG 1", ".if DEBUG", "addi r1 r0 1", ".else", "addi r1 r0 2", ".endif", "halt"), 1},
+		{lines(".equ DEBUG 0", ".if DEBUG", "addi r1 r0 1", ".else", "addi r1 r0 2", ".endif", "halt"), 2},
+		{lines(".if 0", "addi r1 r0 1", ".endif", "halt"), 0},
+		{lines(".if 1", ".if 0", "addi r1 r0 1", ".else", "addi r1 r0 3", ".endif", ".endif", "halt"), 3},
+		{lines(".if 0", ".if 1", "addi r1 r0 1", ".else", "addi r1 r0 3", ".endif", ".endif", "halt"), 0},
+	}
+	for _, entry := range table {
+		out := assemble(t, entry.source)
+		if machine := runWords(t, out.words); machine.GPR[1] != entry.expect {
+			t.Fatalf("%q: expected r1=%d, got %d", entry.source, entry.expect, machine.GPR[1])
+		}
+	}
+}
+
+func TestConditionalsErrors(t *testing.T) {
+	for _, source := range []string{
+		lines(".if 1", "halt"),
+		lines(".else", "halt"),
+		lines(".endif", "halt"),
+		lines(".if 1", ".else", ".else", ".endif"),
+	} {
+		if err := assembleError(t, source); !errors.Is(err, ErrConditional) {
+			t.Fatalf("%q: expected ErrConditional, got %v", source, err)
+		}
+	}
+}
+
+func TestBSS(t *testing.T) {
+	out := assemble(t, lines(
+		"        movi r1 buffer",
+		"        halt",
+		"        .bss kstack 4",
+		"        .bss buffer 2",
+		"after:  .fill 7",
+	))
+	expect := map[string]uint32{"kstack": 3, "buffer": 7, "after": 9}
+	for name, addr := range expect {
+		if out.labels[name] != addr {
+			t.Fatalf("%s: expected 0x%x, got 0x%x", name, addr, out.labels[name])
+		}
+	}
+	if len(out.words) != 10 || out.words[9] != 7 {
+		t.Fatalf("unexpected words: %v", out.words)
+	}
+	for _, word := range out.words[3:9] {
+		if word != 0 {
+			t.Fatalf("the bss region is not zeroed: %v", out.words)
+		}
+	}
+	if machine := runWords(t, out.words); machine.GPR[1] != 7 {
+		t.Fatalf("expected r1=7, got %d", machine.GPR[1])
+	}
+	if err := assembleError(t, lines("buffer: halt", ".bss buffer 2")); !errors.Is(err, ErrRedefined) {
+		t.Fatalf("expected ErrRedefined, got %v", err)
+	}
+	if err := assembleError(t, lines(".bss buffer 0")); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("expected ErrOutOfRange, got %v", err)
+	}
+}
+
+func TestProgramTooLarge(t *testing.T) {
+	source := lines("addi r1 r0 1", ".space 4", "halt")
+	if out := assemble(t, source); len(out.words) != 6 {
+		t.Fatalf("expected 6 words, got %d", len(out.words))
+	}
+	var err error
+	config := Config{MemorySize: 4}
+	for instr := range StartAssemblerWithConfig(strings.NewReader(source), config) {
+		if instr.Error != nil && err == nil {
+			err = instr.Error
+		}
+	}
+	if !errors.Is(err, ErrProgramTooLarge) {
+		t.Fatalf("expected ErrProgramTooLarge, got %v", err)
+	}
+	assembleWithConfig(t, source, Config{MemorySize: 6})
+}
+
+func TestIRET(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // vm.Interrupt logs
+	defer log.SetOutput(os.Stderr)
+	out := assemble(t, lines(
+		"        movi r1 itbl",
+		"        wsr r1 2",
+		"        movi r8 handler",
+		"        sw r8 r1 5",
+		"        movi r8 istack",
+		"        wsr r8 3",
+		"        addi r29 r0 100",
+		"        addi r8 r0 StatusInterrupts",
+		"        wsr r8 0",
+		"        trap 5",
+		"back:   rsr r11 0",      // S[0] after iret
+		"        addi r12 r29 0", // r29 after iret
+		"        wsr r0 0",
+		"        halt",
+		"handler: rsr r10 0",    // S[0] inside the handler
+		"        addi r9 r29 0", // r29 inside the handler
+		"        addi r29 r29 -1",
+		"        iret",
+		"        .align 10",
+		"itbl:   .space 1024",
+		"istack: .fill 0",
+	))
+	if word := out.words[out.labels["handler"]+3]; word != 0x50000000 {
+		t.Fatalf("unexpected iret encoding: 0x%08x", word)
+	}
+	machine := runWords(t, out.words)
+	if machine.GPR[10] != 0 || machine.GPR[9] != out.labels["istack"] {
+		t.Fatalf("unexpected handler state: S[0]=%#x r29=%#x", machine.GPR[10], machine.GPR[9])
+	}
+	if machine.GPR[11] != spec.StatusInterrupts || machine.GPR[12] != 100 {
+		t.Fatalf("iret did not restore: S[0]=%#x r29=%d", machine.GPR[11], machine.GPR[12])
+	}
+	if machine.PC != out.labels["back"]+4 { // after the halt
+		t.Fatalf("unexpected PC after halt: %#x", machine.PC)
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	source := lines(
+		"        addi r1 r0", // too few operands
+		"        addi r2 r0 2",
+		"        frobnicate r1", // unknown instruction
+		"        addi r3 r0 3",
+		"        add r1 r2 r99", // invalid register
+		"        halt",
+	)
+	errorsWithConfig := func(config Config) (linenos []int, errs []error) {
+		for instr := range StartAssemblerWithConfig(strings.NewReader(source), config) {
+			if instr.Error != nil {
+				linenos, errs = append(linenos, instr.Lineno), append(errs, instr.Error)
+			}
+		}
+		return
+	}
+	linenos, errs := errorsWithConfig(Config{})
+	if len(errs) != 3 || linenos[0] != 1 || linenos[1] != 3 || linenos[2] != 5 {
+		t.Fatalf("expected three errors on lines 1, 3, 5, got %v on lines %v", errs, linenos)
+	}
+	for idx, expect := range []error{ErrOperandCount, ErrUnknownInstruction, ErrInvalidRegisterName} {
+		if !errors.Is(errs[idx], expect) {
+			t.Fatalf("error %d: expected %v, got %v", idx, expect, errs[idx])
+		}
+	}
+	linenos, errs = errorsWithConfig(Config{MaxErrors: 1})
+	if len(errs) != 1 || linenos[0] != 1 || !errors.Is(errs[0], ErrOperandCount) {
+		t.Fatalf("expected to stop at the first error, got %v on lines %v", errs, linenos)
+	}
+}
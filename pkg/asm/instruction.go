@@ -1,29 +1,27 @@
 package asm
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
-)
 
-// TODO(bassosimone): maybe create package pkg/spec where we can
-// store the constants defining the ISA?
+	"github.com/bassosimone/risc32/pkg/spec"
+)
 
-// The following constants define the opcodes. We have 5 bits to define
-// opcodes, so up to 32 opcodes. While the opcodes here are related to
-// the ones of RiSC-16, here we have more opcodes and also their values
-// aren't necessarily aligned with the RiSC-16 architecture ones.
+// The following constants define the opcodes (see the spec package).
 const (
-	OpcodeJALR = uint32(iota) // auto-halt when hitting uninit mem
-	OpcodeADD
-	OpcodeADDI
-	OpcodeNAND
-	OpcodeLUI
-	OpcodeSW
-	OpcodeLW
-	OpcodeBEQ
-	OpcodeWSR
-	OpcodeRSR
-	OpcodeIRET
+	OpcodeJALR = spec.OpcodeJALR // auto-halt when hitting uninit mem
+	OpcodeADD  = spec.OpcodeADD
+	OpcodeADDI = spec.OpcodeADDI
+	OpcodeNAND = spec.OpcodeNAND
+	OpcodeLUI  = spec.OpcodeLUI
+	OpcodeSW   = spec.OpcodeSW
+	OpcodeLW   = spec.OpcodeLW
+	OpcodeBEQ  = spec.OpcodeBEQ
+	OpcodeWSR  = spec.OpcodeWSR
+	OpcodeRSR  = spec.OpcodeRSR
+	OpcodeIRET = spec.OpcodeIRET
 )
 
 // Instruction is a parsed instruction.
@@ -39,6 +37,10 @@ type Instruction interface {
 	// Line returns the line where the instruction appears in the input file.
 	Line() int
 
+	// References returns the labels referenced by the instruction. If this
+	// function returns nil, then the instruction does not reference labels.
+	References() []string
+
 	// Encode encodes the instruction. The table passed in input maps each
 	// label to the corresponding offset in memory.
 	Encode(labels map[string]int64, pc uint32) (uint32, error)
@@ -65,6 +67,11 @@ func (ia InstructionErr) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionErr) References() []string {
+	return nil
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionErr) Encode(labels map[string]int64, pc uint32) (uint32, error) {
 	return 0, fmt.Errorf("%w because this is an error", ErrCannotEncode)
@@ -102,6 +109,11 @@ func (ia InstructionADD) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionADD) References() []string {
+	return nil
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionADD) Encode(labels map[string]int64, pc uint32) (uint32, error) {
 	var out uint32
@@ -138,6 +150,11 @@ func (ia InstructionADDI) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionADDI) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionADDI) Encode(labels map[string]int64, pc uint32) (uint32, error) {
 	var out uint32
@@ -178,6 +195,11 @@ func (ia InstructionNAND) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionNAND) References() []string {
+	return nil
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionNAND) Encode(labels map[string]int64, pc uint32) (uint32, error) {
 	var out uint32
@@ -190,12 +212,18 @@ func (ia InstructionNAND) Encode(labels map[string]int64, pc uint32) (uint32, er
 
 var _ Instruction = InstructionNAND{}
 
-// InstructionLUI is the LUI instruction
+// InstructionLUI is the LUI instruction. Imm is the 32-bit value whose
+// upper 22 bits LUI loads, i.e., `lui r1 0x400` loads 0x400 into r1. A
+// negative Imm is meaningful and we encode its two's complement, e.g., `lui
+// r1 -1024` loads 0xfffffc00. A value not fitting 32 bits (as either a
+// signed or an unsigned number) is an error, since its upper bits would
+// not fit into the 22-bit immediate field and we would silently truncate it.
 type InstructionLUI struct {
 	Lineno     int
 	MaybeLabel *string
 	RA         uint32
 	Imm        string
+	Strict     bool // whether to warn when discarding nonzero low bits
 }
 
 // Err implements Instruction.Err
@@ -213,12 +241,22 @@ func (ia InstructionLUI) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionLUI) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionLUI) Encode(labels map[string]int64, pc uint32) (uint32, error) {
 	var out uint32
 	out |= (OpcodeLUI & 0b1_1111) << 27
 	out |= (ia.RA & 0b1_1111) << 22
 	imm, err := ResolveImmediate(labels, ia.Imm, 32, ia.Lineno)
+	if errors.Is(err, ErrOutOfRange) {
+		return 0, fmt.Errorf(
+			"%w: lui of '%s' on line %d: upper bits do not fit 22-bit field",
+			ErrOutOfRange, ia.Imm, ia.Lineno)
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -226,6 +264,18 @@ func (ia InstructionLUI) Encode(labels map[string]int64, pc uint32) (uint32, err
 	return out, nil
 }
 
+// Warn returns an error wrapping ErrLostBits when the instruction is
+// Strict and the low 10 bits of the immediate, which LUI discards, are
+// not zero. We only set Strict for the LUI written by the programmer, since
+// pseudo-instructions like MOVI use LLI to load the low bits.
+func (ia InstructionLUI) Warn(labels map[string]int64) error {
+	imm, err := ResolveImmediate(labels, ia.Imm, 32, ia.Lineno)
+	if err != nil || !ia.Strict || (imm&0b11_1111_1111) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %#x on line %d (did you mean movi?)", ErrLostBits, imm, ia.Lineno)
+}
+
 var _ Instruction = InstructionLUI{}
 
 // InstructionSW is the SW instruction
@@ -252,6 +302,11 @@ func (ia InstructionSW) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionSW) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionSW) Encode(labels map[string]int64, pc uint32) (uint32, error) {
 	var out uint32
@@ -292,6 +347,11 @@ func (ia InstructionLW) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionLW) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionLW) Encode(labels map[string]int64, pc uint32) (uint32, error) {
 	var out uint32
@@ -308,13 +368,16 @@ func (ia InstructionLW) Encode(labels map[string]int64, pc uint32) (uint32, erro
 
 var _ Instruction = InstructionLW{}
 
-// InstructionBEQ is the BEQ instruction
+// InstructionBEQ is the BEQ instruction. The Imm is usually a label or an
+// absolute address and we compute the PC-relative offset when encoding. When
+// Relative is true, instead, Imm already is the PC-relative offset.
 type InstructionBEQ struct {
 	Lineno     int
 	MaybeLabel *string
 	RA         uint32
 	RB         uint32
 	Imm        string
+	Relative   bool
 }
 
 // Err implements Instruction.Err
@@ -332,12 +395,25 @@ func (ia InstructionBEQ) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionBEQ) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionBEQ) Encode(labels map[string]int64, pc uint32) (uint32, error) {
 	var out uint32
 	out |= (OpcodeBEQ & 0b1_1111) << 27
 	out |= (ia.RA & 0b1_1111) << 22
 	out |= (ia.RB & 0b1_1111) << 17
+	if ia.Relative {
+		imm, err := ResolveImmediate(labels, ia.Imm, 17, ia.Lineno)
+		if err != nil {
+			return 0, err
+		}
+		out |= imm & 0b1_1111_1111_1111_1111
+		return out, nil
+	}
 	imm, err := ResolveImmediate(labels, ia.Imm, 32, ia.Lineno)
 	if err != nil {
 		return 0, err
@@ -345,7 +421,9 @@ func (ia InstructionBEQ) Encode(labels map[string]int64, pc uint32) (uint32, err
 	var target int64 = int64(imm) - int64(pc) - 1
 	offset, err := CastToUint32(target, 17, ia.Lineno)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf(
+			"%w: branch to '%s' on line %d is %d words away, exceeds 17-bit range",
+			ErrOutOfRange, ia.Imm, ia.Lineno, target)
 	}
 	out |= offset & 0b1_1111_1111_1111_1111
 	return out, nil
@@ -377,6 +455,11 @@ func (ia InstructionJALR) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionJALR) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionJALR) Encode(labels map[string]int64, pc uint32) (uint32, error) {
 	var out uint32
@@ -419,6 +502,11 @@ func (ia InstructionLLI) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionLLI) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionLLI) Encode(labels map[string]int64, pc uint32) (uint32, error) {
 	var out uint32
@@ -435,10 +523,106 @@ func (ia InstructionLLI) Encode(labels map[string]int64, pc uint32) (uint32, err
 
 var _ Instruction = InstructionLLI{}
 
-// InstructionDATA is the .SPACE or .FILL pseudo-instruction
+// InstructionPCREL is one of the two instructions generated by the
+// PCREL pseudo-instruction. It loads into RA the upper 22 bits (LUI) or,
+// when Low is true, adds the lower 10 bits (LLI) of the offset of Imm
+// relative to the address of the first instruction, whose PC we compute
+// from the pc passed to Encode.
+type InstructionPCREL struct {
+	Lineno     int
+	MaybeLabel *string
+	RA         uint32
+	Imm        string
+	Low        bool
+}
+
+// Err implements Instruction.Err
+func (ia InstructionPCREL) Err() error {
+	return nil
+}
+
+// Label implements Instruction.Label
+func (ia InstructionPCREL) Label() *string {
+	return ia.MaybeLabel
+}
+
+// Line implements Instruction.Line
+func (ia InstructionPCREL) Line() int {
+	return ia.Lineno
+}
+
+// References implements Instruction.References
+func (ia InstructionPCREL) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
+// Encode implements Instruction.Encode
+func (ia InstructionPCREL) Encode(labels map[string]int64, pc uint32) (uint32, error) {
+	imm, err := ResolveImmediate(labels, ia.Imm, 32, ia.Lineno)
+	if err != nil {
+		return 0, err
+	}
+	if ia.Low {
+		pc-- // the offset is relative to the first instruction
+	}
+	offset := fmt.Sprint(imm - pc) // wraps around for negative offsets
+	if ia.Low {
+		return InstructionLLI{Lineno: ia.Lineno, RA: ia.RA, Imm: offset}.Encode(labels, pc)
+	}
+	return InstructionLUI{Lineno: ia.Lineno, RA: ia.RA, Imm: offset}.Encode(labels, pc)
+}
+
+var _ Instruction = InstructionPCREL{}
+
+// InstructionNOT is the NOT pseudo-instruction
+type InstructionNOT struct {
+	Lineno     int
+	MaybeLabel *string
+	RA         uint32
+	RB         uint32
+}
+
+// Err implements Instruction.Err
+func (ia InstructionNOT) Err() error {
+	return nil
+}
+
+// Label implements Instruction.Label
+func (ia InstructionNOT) Label() *string {
+	return ia.MaybeLabel
+}
+
+// Line implements Instruction.Line
+func (ia InstructionNOT) Line() int {
+	return ia.Lineno
+}
+
+// References implements Instruction.References
+func (ia InstructionNOT) References() []string {
+	return nil
+}
+
+// Encode implements Instruction.Encode
+func (ia InstructionNOT) Encode(labels map[string]int64, pc uint32) (uint32, error) {
+	// NOT translates to NAND RA RB RB
+	var out uint32
+	out |= (OpcodeNAND & 0b1_1111) << 27
+	out |= (ia.RA & 0b1_1111) << 22
+	out |= (ia.RB & 0b1_1111) << 17
+	out |= ia.RB & 0b1_1111
+	return out, nil
+}
+
+var _ Instruction = InstructionNOT{}
+
+// InstructionDATA is a data word. The .FILL pseudo-instruction emits a
+// single data word whose value is Imm, while .SPACE reserves memory by
+// emitting a sequence of zero data words. When Imm is not empty, we
+// resolve it when encoding and ignore Value.
 type InstructionDATA struct {
 	Lineno     int
 	MaybeLabel *string
+	Imm        string
 	Value      uint32
 }
 
@@ -457,13 +641,314 @@ func (ia InstructionDATA) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionDATA) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionDATA) Encode(labels map[string]int64, pc uint32) (uint32, error) {
-	return ia.Value, nil
+	if ia.Imm == "" {
+		return ia.Value, nil
+	}
+	return ResolveImmediate(labels, ia.Imm, 32, ia.Lineno)
 }
 
 var _ Instruction = InstructionDATA{}
 
+// InstructionEQU is the .EQU pseudo-instruction. It does not occupy any
+// memory. Rather, ParseAndAppend uses it to define the Name constant.
+type InstructionEQU struct {
+	Lineno     int
+	MaybeLabel *string
+	Name       string
+	Imm        string
+}
+
+// Err implements Instruction.Err
+func (ia InstructionEQU) Err() error {
+	return nil
+}
+
+// Label implements Instruction.Label
+func (ia InstructionEQU) Label() *string {
+	return ia.MaybeLabel
+}
+
+// Line implements Instruction.Line
+func (ia InstructionEQU) Line() int {
+	return ia.Lineno
+}
+
+// References implements Instruction.References
+func (ia InstructionEQU) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
+// Encode implements Instruction.Encode
+func (ia InstructionEQU) Encode(labels map[string]int64, pc uint32) (uint32, error) {
+	return 0, fmt.Errorf("%w: .equ on line %d does not occupy memory",
+		ErrCannotEncode, ia.Lineno)
+}
+
+// Value returns the value of the constant, which may reference labels
+// and constants that have already been defined, or PredefinedConstants.
+func (ia InstructionEQU) Value(labels map[string]int64) (int64, error) {
+	return ResolveConstant(labels, ia.Imm, ia.Lineno)
+}
+
+// ResolveConstant returns the value of imm, which is either a number or the
+// name of a label or constant that has already been defined, or the name of
+// one of the PredefinedConstants. The lineno is used for error reporting.
+func ResolveConstant(labels map[string]int64, imm string, lineno int) (int64, error) {
+	value, err := strconv.ParseInt(imm, 0, 64)
+	if err != nil {
+		var found bool
+		value, found = labels[imm]
+		if !found {
+			value, found = PredefinedConstants[imm]
+		}
+		if !found {
+			return 0, fmt.Errorf("%w '%s' on line %d", ErrUndefinedLabel, imm, lineno)
+		}
+	}
+	return value, nil
+}
+
+var _ Instruction = InstructionEQU{}
+
+// InstructionLABEL is a line containing just a label. It does not occupy
+// any memory. The label refers to the address of the next instruction.
+type InstructionLABEL struct {
+	Lineno     int
+	MaybeLabel *string
+}
+
+// Err implements Instruction.Err
+func (ia InstructionLABEL) Err() error {
+	return nil
+}
+
+// Label implements Instruction.Label
+func (ia InstructionLABEL) Label() *string {
+	return ia.MaybeLabel
+}
+
+// Line implements Instruction.Line
+func (ia InstructionLABEL) Line() int {
+	return ia.Lineno
+}
+
+// References implements Instruction.References
+func (ia InstructionLABEL) References() []string {
+	return nil
+}
+
+// Encode implements Instruction.Encode
+func (ia InstructionLABEL) Encode(labels map[string]int64, pc uint32) (uint32, error) {
+	return 0, fmt.Errorf("%w: label on line %d does not occupy memory",
+		ErrCannotEncode, ia.Lineno)
+}
+
+var _ Instruction = InstructionLABEL{}
+
+// InstructionALIGN is the .ALIGN pseudo-instruction. It does not occupy
+// any memory by itself. Rather, ParseAndAppend replaces it with as many zero
+// words as needed to align the next instruction to a 1<<Bits boundary.
+type InstructionALIGN struct {
+	Lineno     int
+	MaybeLabel *string
+	Bits       uint32
+}
+
+// Err implements Instruction.Err
+func (ia InstructionALIGN) Err() error {
+	return nil
+}
+
+// Label implements Instruction.Label
+func (ia InstructionALIGN) Label() *string {
+	return ia.MaybeLabel
+}
+
+// Line implements Instruction.Line
+func (ia InstructionALIGN) Line() int {
+	return ia.Lineno
+}
+
+// References implements Instruction.References
+func (ia InstructionALIGN) References() []string {
+	return nil
+}
+
+// Encode implements Instruction.Encode
+func (ia InstructionALIGN) Encode(labels map[string]int64, pc uint32) (uint32, error) {
+	return 0, fmt.Errorf("%w: .align on line %d does not occupy memory",
+		ErrCannotEncode, ia.Lineno)
+}
+
+var _ Instruction = InstructionALIGN{}
+
+// InstructionBSS is the .BSS pseudo-instruction. It does not occupy any
+// memory by itself. Rather, ParseAndAppend binds Name to the current address
+// and replaces it with Count zero words, like a labeled .SPACE would do.
+type InstructionBSS struct {
+	Lineno     int
+	MaybeLabel *string
+	Name       string
+	Count      uint32
+}
+
+// Err implements Instruction.Err
+func (ia InstructionBSS) Err() error {
+	return nil
+}
+
+// Label implements Instruction.Label
+func (ia InstructionBSS) Label() *string {
+	return ia.MaybeLabel
+}
+
+// Line implements Instruction.Line
+func (ia InstructionBSS) Line() int {
+	return ia.Lineno
+}
+
+// References implements Instruction.References
+func (ia InstructionBSS) References() []string {
+	return nil
+}
+
+// Encode implements Instruction.Encode
+func (ia InstructionBSS) Encode(labels map[string]int64, pc uint32) (uint32, error) {
+	return 0, fmt.Errorf("%w: .bss on line %d does not occupy memory",
+		ErrCannotEncode, ia.Lineno)
+}
+
+var _ Instruction = InstructionBSS{}
+
+// InstructionCOND is one of the .IF, .ELSE, and .ENDIF pseudo-instructions
+// used for conditional assembly. It does not occupy any memory. Rather, the
+// assembler uses it to decide which lines to assemble and which to skip.
+type InstructionCOND struct {
+	Lineno     int
+	MaybeLabel *string
+	Directive  string // one of ".if", ".else", and ".endif"
+	Imm        string // condition (only for .if)
+}
+
+// Err implements Instruction.Err
+func (ia InstructionCOND) Err() error {
+	return nil
+}
+
+// Label implements Instruction.Label
+func (ia InstructionCOND) Label() *string {
+	return ia.MaybeLabel
+}
+
+// Line implements Instruction.Line
+func (ia InstructionCOND) Line() int {
+	return ia.Lineno
+}
+
+// References implements Instruction.References
+func (ia InstructionCOND) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
+// Encode implements Instruction.Encode
+func (ia InstructionCOND) Encode(labels map[string]int64, pc uint32) (uint32, error) {
+	return 0, fmt.Errorf("%w: %s on line %d does not occupy memory",
+		ErrCannotEncode, ia.Directive, ia.Lineno)
+}
+
+var _ Instruction = InstructionCOND{}
+
+// InstructionENTRY is the .ENTRY pseudo-instruction. It does not occupy
+// any memory. Rather, it tells the assembler which is the address of the
+// first instruction to execute, i.e., the entry point.
+type InstructionENTRY struct {
+	Lineno     int
+	MaybeLabel *string
+	Imm        string
+}
+
+// Err implements Instruction.Err
+func (ia InstructionENTRY) Err() error {
+	return nil
+}
+
+// Label implements Instruction.Label
+func (ia InstructionENTRY) Label() *string {
+	return ia.MaybeLabel
+}
+
+// Line implements Instruction.Line
+func (ia InstructionENTRY) Line() int {
+	return ia.Lineno
+}
+
+// References implements Instruction.References
+func (ia InstructionENTRY) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
+// Encode implements Instruction.Encode
+func (ia InstructionENTRY) Encode(labels map[string]int64, pc uint32) (uint32, error) {
+	return 0, fmt.Errorf("%w: .entry on line %d does not occupy memory",
+		ErrCannotEncode, ia.Lineno)
+}
+
+var _ Instruction = InstructionENTRY{}
+
+// InstructionINCLUDE is the .INCLUDE pseudo-instruction. It does not
+// occupy any memory. Rather, ParseAndAppend replaces it with the
+// instructions contained by the file at Path.
+type InstructionINCLUDE struct {
+	Lineno     int
+	MaybeLabel *string
+	Path       string
+}
+
+// Err implements Instruction.Err
+func (ia InstructionINCLUDE) Err() error {
+	return nil
+}
+
+// Label implements Instruction.Label
+func (ia InstructionINCLUDE) Label() *string {
+	return ia.MaybeLabel
+}
+
+// Line implements Instruction.Line
+func (ia InstructionINCLUDE) Line() int {
+	return ia.Lineno
+}
+
+// References implements Instruction.References
+func (ia InstructionINCLUDE) References() []string {
+	return nil
+}
+
+// Encode implements Instruction.Encode
+func (ia InstructionINCLUDE) Encode(labels map[string]int64, pc uint32) (uint32, error) {
+	return 0, fmt.Errorf("%w: .include on line %d does not occupy memory",
+		ErrCannotEncode, ia.Lineno)
+}
+
+var _ Instruction = InstructionINCLUDE{}
+
+// InstructionIncluded is an instruction coming from File, which is either
+// an included file or a runtime routine. We use this wrapper to remember
+// where the instruction comes from, so that we can report errors properly.
+type InstructionIncluded struct {
+	Instruction
+	File string
+}
+
+var _ Instruction = InstructionIncluded{}
+
 // InstructionWSR is the WSR instruction
 type InstructionWSR struct {
 	Lineno     int
@@ -487,6 +972,11 @@ func (ia InstructionWSR) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionWSR) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionWSR) Encode(labels map[string]int64, pc uint32) (uint32, error) {
 	var out uint32
@@ -496,7 +986,7 @@ func (ia InstructionWSR) Encode(labels map[string]int64, pc uint32) (uint32, err
 	if err != nil {
 		return 0, err
 	}
-	out |= imm & 0b11_1111_1111_1111_1111
+	out |= imm & 0b11_1111_1111_1111_1111_1111
 	return out, nil
 }
 
@@ -525,6 +1015,11 @@ func (ia InstructionRSR) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionRSR) References() []string {
+	return ReferencedLabels(ia.Imm)
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionRSR) Encode(labels map[string]int64, pc uint32) (uint32, error) {
 	var out uint32
@@ -534,7 +1029,7 @@ func (ia InstructionRSR) Encode(labels map[string]int64, pc uint32) (uint32, err
 	if err != nil {
 		return 0, err
 	}
-	out |= imm & 0b11_1111_1111_1111_1111
+	out |= imm & 0b11_1111_1111_1111_1111_1111
 	return out, nil
 }
 
@@ -561,6 +1056,11 @@ func (ia InstructionIRET) Line() int {
 	return ia.Lineno
 }
 
+// References implements Instruction.References
+func (ia InstructionIRET) References() []string {
+	return nil
+}
+
 // Encode implements Instruction.Encode
 func (ia InstructionIRET) Encode(labels map[string]int64, pc uint32) (uint32, error) {
 	var out uint32
@@ -570,6 +1070,18 @@ func (ia InstructionIRET) Encode(labels map[string]int64, pc uint32) (uint32, er
 
 var _ Instruction = InstructionIRET{}
 
+// ReferencedLabels returns the labels referenced by an immediate. If
+// the immediate is empty or a number, this function returns nil.
+func ReferencedLabels(name string) []string {
+	if name == "" {
+		return nil
+	}
+	if _, err := strconv.ParseInt(name, 0, 64); err == nil {
+		return nil
+	}
+	return []string{name}
+}
+
 // ResolveImmediate resolves the value of an immediate
 func ResolveImmediate(
 	labels map[string]int64, name string, bits, lineno int) (uint32, error) {
@@ -585,12 +1097,18 @@ func ResolveImmediate(
 	return CastToUint32(value, bits, lineno)
 }
 
-// CastToUint32 casts the given value to uint32
+// CastToUint32 casts the given value to uint32. The value must fit into
+// a signed integer with the given number of bits, except that 32-bit values
+// may also be unsigned, so that, e.g., 0xffffffff is a valid 32-bit value.
 func CastToUint32(value int64, bits, lineno int) (uint32, error) {
 	if bits < 1 || bits > 32 {
 		panic("bits value out of range")
 	}
-	if value < -(1<<(bits-1)) || value > ((1<<(bits-1))-1) {
+	max := int64((1 << (bits - 1)) - 1)
+	if bits == 32 {
+		max = math.MaxUint32
+	}
+	if value < -(1<<(bits-1)) || value > max {
 		return 0, fmt.Errorf("%w for %d-bit range on line %d", ErrOutOfRange, bits, lineno)
 	}
 	return uint32(value), nil
@@ -16,6 +16,7 @@ type LexerRule struct {
 // The following constants enumerate all token types.
 const (
 	LexerBlank        = "Blank"
+	LexerCharacter    = "Character"
 	LexerComment      = "Comment"
 	LexerEOF          = ""
 	LexerEOL          = "EOL"
@@ -23,6 +24,7 @@ const (
 	LexerInvalid      = "Invalid"
 	LexerLabel        = "Label"
 	LexerNameOrNumber = "NameOrNumber"
+	LexerString       = "String"
 )
 
 // LexerRules contains the lexer rules. Note that all lexer rules start
@@ -36,12 +38,20 @@ var LexerRules = []LexerRule{{
 	Type: LexerLabel,
 }, {
 	Emit: true,
-	RE:   regexp.MustCompile(`^[.a-zA-Z_][a-zA-Z0-9_]*`),
+	RE:   regexp.MustCompile(`^[.$a-zA-Z_][a-zA-Z0-9_]*`),
 	Type: LexerNameOrNumber,
 }, {
 	Emit: true,
-	RE:   regexp.MustCompile(`^(0|-?[1-9][0-9]*)`),
+	RE:   regexp.MustCompile(`^-?(0[xX][0-9a-fA-F]+|0[bB][01]+|[1-9][0-9]*|0)`),
 	Type: LexerNameOrNumber,
+}, {
+	Emit: true,
+	RE:   regexp.MustCompile(`^'([^'\\]|\\[^']+|\\')'`),
+	Type: LexerCharacter,
+}, {
+	Emit: true,
+	RE:   regexp.MustCompile(`^"[^"]*"`),
+	Type: LexerString,
 }, {
 	RE:   regexp.MustCompile(`^[ \t]+`),
 	Type: LexerBlank,
@@ -0,0 +1,168 @@
+package asm
+
+import (
+	"sort"
+	"strconv"
+)
+
+// alignment records the padding that .align added to the instructions
+// between start and end, so that the optimizer can recompute it.
+type alignment struct {
+	bits   uint32 // alignment bits
+	end    int64  // index of the aligned instruction
+	file   string // file containing the .align directive
+	lineno int    // line of the .align directive
+	start  int64  // index of the first padding word
+}
+
+// optimize is the peephole optimizer. It removes the following
+// instructions, which do not change the state of the VM:
+//
+// - `nop` (i.e., `add r0 r0 r0`);
+//
+// - `add rA rA r0` and `add rA r0 rA` (i.e., `mov rA rA`);
+//
+// - `addi rA rA 0`;
+//
+// - `mov rB rA` immediately following `mov rA rB`, provided that no label
+// refers to it, since after the first move the two registers are equal.
+//
+// A label referring to a removed instruction refers to the next instruction
+// that we keep. We also update constants defined using labels, recompute the
+// padding added by .align, and never remove instructions that are skipped
+// by a PC-relative branch generated by pseudo-instructions.
+//
+// Because we only update the addresses that the program refers to using
+// labels, the program must not refer to instructions using numbers, e.g.,
+// `beq r0 r0 0x10`, `.fill 0x10`, or `.entry 0x10`.
+func (a *assembler) optimize() {
+	targets := make(map[int64]bool)
+	for name := range a.addresses {
+		targets[a.labels[name]] = true
+	}
+	pinned := make(map[int64]bool)
+	for idx, instr := range a.instructions {
+		beq, ok := unwrapIncluded(instr).(InstructionBEQ)
+		if !ok || !beq.Relative {
+			continue
+		}
+		offset, err := strconv.ParseInt(beq.Imm, 0, 64)
+		if err != nil {
+			continue // cannot happen with pseudo-instructions
+		}
+		first, last := int64(idx)+1, int64(idx)+offset
+		if offset < 0 {
+			first, last = int64(idx)+1+offset, int64(idx)
+		}
+		for pc := first; pc <= last; pc++ {
+			pinned[pc] = true
+		}
+		targets[int64(idx)+1+offset] = true
+	}
+	keep := make([]bool, len(a.instructions))
+	for idx, instr := range a.instructions {
+		keep[idx] = pinned[int64(idx)] || !isNoOp(unwrapIncluded(instr))
+		if idx > 0 && !pinned[int64(idx)] && !targets[int64(idx)] && isSwappedMove(
+			unwrapIncluded(a.instructions[idx-1]), unwrapIncluded(instr)) {
+			keep[idx] = false
+		}
+	}
+	var (
+		aligns       = a.aligns
+		instructions []Instruction
+		remap        = make([]int64, len(a.instructions)+1)
+	)
+	for idx := int64(0); idx < int64(len(a.instructions)); idx++ {
+		if len(aligns) > 0 && aligns[0].start == idx {
+			for pc := idx; pc < aligns[0].end; pc++ {
+				remap[pc] = int64(len(instructions))
+			}
+			instructions = aligns[0].pad(instructions)
+			idx, aligns = aligns[0].end-1, aligns[1:]
+			continue
+		}
+		remap[idx] = int64(len(instructions))
+		if keep[idx] {
+			instructions = append(instructions, a.instructions[idx])
+		}
+	}
+	// Handle .align directives at the end of the program.
+	for ; len(aligns) > 0; aligns = aligns[1:] {
+		instructions = aligns[0].pad(instructions)
+	}
+	remap[len(a.instructions)] = int64(len(instructions))
+	for name := range a.addresses {
+		if addr := a.labels[name]; addr >= 0 && addr < int64(len(remap)) {
+			a.labels[name] = remap[addr]
+		}
+	}
+	// When several labels end up at the same address, the
+	// one that was closest to the kept instruction wins.
+	var addrs []int64
+	for addr := range a.symbols {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	symbols := make(map[int64]string)
+	for _, addr := range addrs {
+		if addr >= 0 && addr < int64(len(remap)) {
+			symbols[remap[addr]] = a.symbols[addr]
+		}
+	}
+	a.instructions, a.symbols = instructions, symbols
+}
+
+// pad appends to instructions the padding required by the .align
+// directive, given the current number of instructions.
+func (al alignment) pad(instructions []Instruction) []Instruction {
+	for int64(len(instructions))%(1<<al.bits) != 0 {
+		var pad Instruction = InstructionDATA{Lineno: al.lineno}
+		if al.file != "" {
+			pad = InstructionIncluded{Instruction: pad, File: al.file}
+		}
+		instructions = append(instructions, pad)
+	}
+	return instructions
+}
+
+// isNoOp returns whether instr does not change the state of the VM.
+func isNoOp(instr Instruction) bool {
+	switch instr := instr.(type) {
+	case InstructionADD:
+		return (instr.RA == instr.RB && instr.RC == 0) ||
+			(instr.RA == instr.RC && instr.RB == 0)
+	case InstructionADDI:
+		value, err := strconv.ParseInt(instr.Imm, 0, 64)
+		return instr.RA == instr.RB && err == nil && value == 0
+	default:
+		return false
+	}
+}
+
+// isSwappedMove returns whether first is `mov rA rB` and
+// second is `mov rB rA`, where we consider `add rA rB r0` and
+// `add rA r0 rB` to be equivalent to `mov rA rB`.
+func isSwappedMove(first, second Instruction) bool {
+	ra, rb, ok := moveOperands(first)
+	if !ok {
+		return false
+	}
+	rc, rd, ok := moveOperands(second)
+	return ok && ra == rd && rb == rc
+}
+
+// moveOperands returns the destination and source registers
+// of instr, if instr is a move between registers.
+func moveOperands(instr Instruction) (uint32, uint32, bool) {
+	add, ok := instr.(InstructionADD)
+	switch {
+	case !ok:
+		return 0, 0, false
+	case add.RC == 0:
+		return add.RA, add.RB, true
+	case add.RB == 0:
+		return add.RA, add.RC, true
+	default:
+		return 0, 0, false
+	}
+}
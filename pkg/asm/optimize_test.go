@@ -0,0 +1,101 @@
+package asm
+
+import "testing"
+
+// optimizerProgram contains redundancies that the optimizer should
+// remove, along with labels, .align, and PC-relative branches.
+var optimizerProgram = lines(
+	"        movi $sp stack",
+	"        addi r2 r0 5",
+	"        nop",
+	"        addi r2 r2 0",
+	"        mov r3 r2",
+	"        mov r2 r3",    // swapped move
+	"        add r4 r4 r0", // mov r4 r4
+	"loop:   nop",          // label on a removed instruction
+	"        addi r5 r5 1",
+	"        addi r2 r2 -1",
+	"        bne r2 r0 loop", // PC-relative
+	"        movi r6 table",
+	"        lw r7 r6 1",
+	"        call square",
+	"        halt",
+	"square: mov r8 r7",
+	"        mul r8 r8 r7",
+	"        ret",
+	"        .align 4",
+	"table:  .fill 11",
+	"        .fill 12",
+	"        .space 16",
+	"stack:  .fill 0", // the stack grows downwards
+)
+
+func TestOptimizePreservesSemantics(t *testing.T) {
+	plain := assemble(t, optimizerProgram)
+	optimized := assembleWithConfig(t, optimizerProgram, Config{Optimize: true})
+	if removed := len(plain.words) - len(optimized.words); removed <= 0 {
+		t.Fatalf("expected the optimizer to remove words, removed %d", removed)
+	}
+	pvm, ovm := runWords(t, plain.words), runWords(t, optimized.words)
+	for _, reg := range []int{2, 3, 4, 5, 7, 8} { // r6 is an address
+		if pvm.GPR[reg] != ovm.GPR[reg] {
+			t.Fatalf("r%d: %d != %d", reg, pvm.GPR[reg], ovm.GPR[reg])
+		}
+	}
+	if ovm.GPR[5] != 5 || ovm.GPR[8] != 144 {
+		t.Fatalf("unexpected results: r5=%d r8=%d", ovm.GPR[5], ovm.GPR[8])
+	}
+	if addr := optimized.labels["table"]; addr%16 != 0 || addr >= plain.labels["table"] {
+		t.Fatalf("table not realigned: 0x%x (was 0x%x)", addr, plain.labels["table"])
+	}
+}
+
+func TestOptimizeRemovesRedundancies(t *testing.T) {
+	optimized := assembleWithConfig(t, lines(
+		"start: nop",
+		"       addi r2 r2 0",
+		"       add r3 r3 r0",
+		"       add r3 r0 r3",
+		"       mov r4 r5",
+		"       mov r5 r4",
+		"       halt",
+	), Config{Optimize: true})
+	expect := []uint32{
+		0x090a0000, // add r4 r5 r0, i.e., mov r4 r5
+		0x00000000, // halt
+	}
+	if len(optimized.words) != len(expect) {
+		t.Fatalf("expected %d words, got %d", len(expect), len(optimized.words))
+	}
+	for idx, word := range expect {
+		if optimized.words[idx] != word {
+			t.Fatalf("word %d: expected 0x%08x, got 0x%08x", idx, word, optimized.words[idx])
+		}
+	}
+	if addr, found := optimized.labels["start"]; !found || addr != 0 {
+		t.Fatalf("start label not retargeted: %d %v", addr, found)
+	}
+}
+
+func TestOptimizeKeepsBranchTargets(t *testing.T) {
+	// The second move is the target of a branch, so that it is not
+	// redundant when we enter the loop through the branch.
+	source := lines(
+		"       addi r2 r0 3",
+		"       mov r3 r4",
+		"again: mov r4 r3",
+		"       addi r3 r3 1",
+		"       addi r2 r2 -1",
+		"       bne r2 r0 again",
+		"       halt",
+	)
+	plain := assemble(t, source)
+	optimized := assembleWithConfig(t, source, Config{Optimize: true})
+	if len(plain.words) != len(optimized.words) {
+		t.Fatalf("expected no changes: %d != %d words", len(plain.words), len(optimized.words))
+	}
+	pvm, ovm := runWords(t, plain.words), runWords(t, optimized.words)
+	if pvm.GPR[3] != ovm.GPR[3] || pvm.GPR[4] != ovm.GPR[4] {
+		t.Fatal("the optimizer changed the semantics")
+	}
+}
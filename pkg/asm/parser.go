@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+
+	"github.com/bassosimone/risc32/pkg/spec"
 )
 
 // ParseSpecificInstruction is the function parsing a specific instruction.
@@ -13,24 +15,122 @@ type ParseSpecificInstruction func(
 
 // InstructionParsers maps an instruction to its parser.
 var InstructionParsers = map[string]ParseSpecificInstruction{
-	"add":    ParseADD,
-	"addi":   ParseADDI,
-	"nand":   ParseNAND,
-	"lui":    ParseLUI,
-	"sw":     ParseSW,
-	"lw":     ParseLW,
-	"beq":    ParseBEQ,
-	"jalr":   ParseJALR,
-	"nop":    ParseNOP,
-	"halt":   ParseHALT,
-	"lli":    ParseLLI,
-	"movi":   ParseMOVI,
-	".fill":  ParseFILL,
-	".space": ParseSPACE,
-	"wsr":    ParseWSR,
-	"rsr":    ParseRSR,
-	"trap":   ParseTRAP,
-	"iret":   ParseIRET,
+	"add":      ParseADD,
+	"addi":     ParseADDI,
+	"nand":     ParseNAND,
+	"lui":      ParseLUI,
+	"sw":       ParseSW,
+	"lw":       ParseLW,
+	"beq":      ParseBEQ,
+	"jalr":     ParseJALR,
+	"nop":      ParseNOP,
+	"halt":     ParseHALT,
+	"lli":      ParseLLI,
+	"movi":     ParseMOVI,
+	".fill":    ParseFILL,
+	".space":   ParseSPACE,
+	".bss":     ParseBSS,
+	".equ":     ParseEQU,
+	".include": ParseINCLUDE,
+	".align":   ParseALIGN,
+	".entry":   ParseENTRY,
+	".if":      ParseIF,
+	".else":    ParseELSE,
+	".endif":   ParseENDIF,
+	"wsr":      ParseWSR,
+	"rsr":      ParseRSR,
+	"trap":     ParseTRAP,
+	"iret":     ParseIRET,
+	"slli":     ParseSLLI,
+	"srli":     ParseSRLI,
+	"not":      ParseNOT,
+	"mov":      ParseMOV,
+	"call":     ParseCALL,
+	"ret":      ParseRET,
+	"and":      ParseAND,
+	"or":       ParseOR,
+	"xor":      ParseXOR,
+	"bne":      ParseBNE,
+	"jmp":      ParseJMP,
+	"mul":      ParseMUL,
+	"blt":      ParseBLT,
+	"bltu":     ParseBLTU,
+	"lb":       ParseLB,
+	"sb":       ParseSB,
+	"li":       ParseLI,
+	"jal":      ParseJAL,
+	"pcrel":    ParsePCREL,
+}
+
+// InstructionUsage maps an instruction to its expected form, which we use
+// to check the number of operands and to print helpful error messages. An
+// operand between square brackets is optional.
+var InstructionUsage = map[string]string{
+	"add":      "add rA rB rC",
+	"addi":     "addi rA rB imm",
+	"nand":     "nand rA rB rC",
+	"lui":      "lui rA imm",
+	"sw":       "sw rA rB imm",
+	"lw":       "lw rA rB imm",
+	"beq":      "beq rA rB label",
+	"jalr":     "jalr rA rB [imm]",
+	"nop":      "nop",
+	"halt":     "halt",
+	"lli":      "lli rA imm",
+	"movi":     "movi rA imm",
+	".fill":    ".fill imm",
+	".space":   ".space count",
+	".bss":     ".bss name count",
+	".equ":     ".equ name imm",
+	".include": `.include "path"`,
+	".align":   ".align bits",
+	".entry":   ".entry label",
+	".if":      ".if imm",
+	".else":    ".else",
+	".endif":   ".endif",
+	"wsr":      "wsr rA imm",
+	"rsr":      "rsr rA imm",
+	"trap":     "trap imm",
+	"iret":     "iret",
+	"slli":     "slli rA rB imm",
+	"srli":     "srli rA rB imm",
+	"not":      "not rA rB",
+	"mov":      "mov rA rB",
+	"call":     "call label",
+	"ret":      "ret",
+	"and":      "and rA rB rC",
+	"or":       "or rA rB rC",
+	"xor":      "xor rA rB rC",
+	"bne":      "bne rA rB label",
+	"jmp":      "jmp label",
+	"mul":      "mul rA rB rC",
+	"blt":      "blt rA rB label",
+	"bltu":     "bltu rA rB label",
+	"lb":       "lb rA rB",
+	"sb":       "sb rA rB",
+	"li":       "li rA imm",
+	"jal":      "jal rA label",
+	"pcrel":    "pcrel rA label",
+}
+
+// The following constants define the registers reserved by the
+// register conventions used by pseudo-instructions.
+const (
+	RegisterTemporary = 1  // assembler temporary register
+	RegisterStack     = 29 // stack pointer register
+	RegisterLink      = 31 // link register
+)
+
+// RegisterAliases maps MIPS-like register aliases, which you can use
+// instead of the numeric register names, to register numbers. Note that
+// only $at, $sp, and $ra have a special meaning for the assembler.
+var RegisterAliases = map[string]uint32{
+	"$zero": 0,
+	"$at":   RegisterTemporary,
+	"$gp":   28,
+	"$sp":   RegisterStack,
+	"$fp":   30,
+	"$ra":   RegisterLink,
 }
 
 // The following errors may occur when assembling.
@@ -42,6 +142,19 @@ var (
 	ErrOutOfRange           = errors.New("asm: immediate value out of range")
 	ErrCannotEncode         = errors.New("asm: can't encode instruction")
 	ErrTooManyInstructions  = errors.New("asm: too many instructions")
+	ErrProgramTooLarge      = errors.New("asm: program too large")
+	ErrNotSupported         = errors.New("asm: instruction not supported")
+	ErrReservedRegister     = errors.New("asm: register reserved by the assembler")
+	ErrUndefinedLabel       = errors.New("asm: undefined label")
+	ErrRedefined            = errors.New("asm: label or constant redefined")
+	ErrExpectedString       = errors.New("asm: expected string")
+	ErrIncludeCycle         = errors.New("asm: include cycle")
+	ErrMultipleEntries      = errors.New("asm: multiple entry points")
+	ErrBadEntry             = errors.New("asm: entry point outside of the program")
+	ErrConditional          = errors.New("asm: invalid conditional directive")
+	ErrLostBits             = errors.New("asm: lui discards the low 10 bits")
+	ErrOperandCount         = errors.New("asm: wrong number of operands")
+	ErrTooManyErrors        = errors.New("asm: too many errors")
 )
 
 // StartParsing starts parsing in a backend goroutine.
@@ -94,16 +207,58 @@ again:
 	// 2. parse the instruction
 	switch token.Type {
 	case LexerNameOrNumber:
+	case LexerEOL:
+		if label != nil { // label-only line
+			return []Instruction{InstructionLABEL{Lineno: token.Lineno, MaybeLabel: label}}
+		}
+		fallthrough
 	default:
-		return NewParseError(fmt.Errorf("%w while parsing instruction name on line %d",
-			ErrExpectedNameOrNumber, token.Lineno))
+		return []Instruction{InstructionErr{
+			Error: fmt.Errorf("%w while parsing instruction name on line %d",
+				ErrExpectedNameOrNumber, token.Lineno),
+			Lineno: token.Lineno,
+		}}
 	}
 	parser := InstructionParsers[token.Value]
 	if parser == nil {
-		return NewParseError(fmt.Errorf("%w while processing instruction name on line %d",
-			ErrUnknownInstruction, token.Lineno))
+		return []Instruction{InstructionErr{
+			Error: fmt.Errorf("%w while processing instruction name on line %d",
+				ErrUnknownInstruction, token.Lineno),
+			Lineno: token.Lineno,
+		}}
+	}
+	// 3. check the number of operands, if we know the expected form
+	if usage, found := InstructionUsage[token.Value]; found {
+		var operands []LexerToken
+		eol := <-in
+		for ; eol.Type != LexerEOL && eol.Type != LexerEOF; eol = <-in {
+			operands = append(operands, eol)
+		}
+		expected := strings.Fields(usage)[1:]
+		required := 0
+		for _, operand := range expected {
+			if !strings.HasPrefix(operand, "[") {
+				required++
+			}
+		}
+		if len(operands) < required || len(operands) > len(expected) {
+			return []Instruction{InstructionErr{
+				Error: fmt.Errorf("%w on line %d: expected `%s`",
+					ErrOperandCount, token.Lineno, usage),
+				Lineno: token.Lineno,
+			}}
+		}
+		in = feed(append(operands, LexerToken{Lineno: token.Lineno, Type: LexerEOL}))
+	}
+	out := parser(in, label, token.Lineno)
+	// 4. make sure errors know the line, so we can quote its text
+	for idx, instr := range out {
+		if ie, ok := instr.(InstructionErr); ok && ie.Lineno == 0 {
+			ie.Lineno = token.Lineno
+			out[idx] = ie
+		}
 	}
-	return parser(in, label, token.Lineno)
+	return out
 }
 
 // ParseADD parses the ADD instruction
@@ -202,6 +357,7 @@ func ParseLUI(in <-chan LexerToken, label *string, lineno int) []Instruction {
 		MaybeLabel: label,
 		RA:         ra,
 		Imm:        imm,
+		Strict:     true,
 	}}
 }
 
@@ -293,14 +449,23 @@ func ParseJALR(in <-chan LexerToken, label *string, lineno int) []Instruction {
 	if err != nil {
 		return NewParseError(err)
 	}
-	if err := ParseEOL(in); err != nil {
-		return NewParseError(err)
+	// The optional immediate is the interrupt code of `jalr r0 r0 imm`,
+	// which is equivalent to `trap imm`. The VM ignores it otherwise.
+	var imm string
+	if token := <-in; token.Type != LexerEOL {
+		if imm, err = immediateValue(token); err != nil {
+			return NewParseError(err)
+		}
+		if err := ParseEOL(in); err != nil {
+			return NewParseError(err)
+		}
 	}
 	return []Instruction{InstructionJALR{
 		Lineno:     lineno,
 		MaybeLabel: label,
 		RA:         ra,
 		RB:         rb,
+		Imm:        imm,
 	}}
 }
 
@@ -386,14 +551,10 @@ func ParseFILL(in <-chan LexerToken, label *string, lineno int) []Instruction {
 	if err := ParseEOL(in); err != nil {
 		return NewParseError(err)
 	}
-	value, err := strconv.ParseInt(imm, 0, 32)
-	if err != nil {
-		return NewParseError(fmt.Errorf("%w for data", ErrOutOfRange))
-	}
 	return []Instruction{InstructionDATA{
 		Lineno:     lineno,
 		MaybeLabel: label,
-		Value:      uint32(value),
+		Imm:        imm,
 	}}
 }
 
@@ -406,9 +567,11 @@ func ParseSPACE(in <-chan LexerToken, label *string, lineno int) (out []Instruct
 	if err := ParseEOL(in); err != nil {
 		return NewParseError(err)
 	}
+	// Note: we check the count here to avoid allocating a huge number
+	// of instructions before we discover that the program is too large.
 	count, err := strconv.ParseUint(imm, 0, 32)
-	if err != nil || count <= 0 {
-		return NewParseError(fmt.Errorf("%w for data", ErrOutOfRange))
+	if err != nil || count <= 0 || count > spec.MemorySize {
+		return NewParseError(fmt.Errorf("%w for space on line %d", ErrOutOfRange, lineno))
 	}
 	for i := uint64(0); i < count; i++ {
 		out = append(out, InstructionDATA{Lineno: lineno, MaybeLabel: label})
@@ -417,6 +580,154 @@ func ParseSPACE(in <-chan LexerToken, label *string, lineno int) (out []Instruct
 	return
 }
 
+// ParseBSS parses the .BSS pseudo-instruction
+func ParseBSS(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	name, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	imm, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	if ReferencedLabels(name) == nil {
+		return NewParseError(fmt.Errorf("%w while parsing region name on line %d",
+			ErrExpectedNameOrNumber, lineno))
+	}
+	count, err := strconv.ParseUint(imm, 0, 32)
+	if err != nil || count <= 0 || count > spec.MemorySize {
+		return NewParseError(fmt.Errorf("%w for bss on line %d", ErrOutOfRange, lineno))
+	}
+	return []Instruction{InstructionBSS{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Name:       name,
+		Count:      uint32(count),
+	}}
+}
+
+// ParseEQU parses the .EQU pseudo-instruction
+func ParseEQU(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	name, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	imm, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	if ReferencedLabels(name) == nil {
+		return NewParseError(fmt.Errorf("%w while parsing constant name on line %d",
+			ErrExpectedNameOrNumber, lineno))
+	}
+	return []Instruction{InstructionEQU{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Name:       name,
+		Imm:        imm,
+	}}
+}
+
+// ParseALIGN parses the .ALIGN pseudo-instruction
+func ParseALIGN(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	imm, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	bits, err := strconv.ParseUint(imm, 0, 32)
+	if err != nil || (1<<bits) > spec.MemorySize {
+		return NewParseError(fmt.Errorf("%w for alignment on line %d", ErrOutOfRange, lineno))
+	}
+	return []Instruction{InstructionALIGN{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Bits:       uint32(bits),
+	}}
+}
+
+// ParseENTRY parses the .ENTRY pseudo-instruction
+func ParseENTRY(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	imm, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	return []Instruction{InstructionENTRY{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Imm:        imm,
+	}}
+}
+
+// ParseIF parses the .IF pseudo-instruction
+func ParseIF(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	imm, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	return []Instruction{InstructionCOND{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Directive:  ".if",
+		Imm:        imm,
+	}}
+}
+
+// ParseELSE parses the .ELSE pseudo-instruction
+func ParseELSE(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	return []Instruction{InstructionCOND{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Directive:  ".else",
+	}}
+}
+
+// ParseENDIF parses the .ENDIF pseudo-instruction
+func ParseENDIF(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	return []Instruction{InstructionCOND{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Directive:  ".endif",
+	}}
+}
+
+// ParseINCLUDE parses the .INCLUDE pseudo-instruction
+func ParseINCLUDE(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	token := <-in
+	if token.Type != LexerString {
+		return NewParseError(fmt.Errorf("%w while parsing included file on line %d",
+			ErrExpectedString, token.Lineno))
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	return []Instruction{InstructionINCLUDE{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Path:       strings.Trim(token.Value, `"`),
+	}}
+}
+
 // ParseWSR parses the WSR instruction
 func ParseWSR(in <-chan LexerToken, label *string, lineno int) []Instruction {
 	ra, err := ParseRegister(in)
@@ -486,6 +797,537 @@ func ParseIRET(in <-chan LexerToken, label *string, lineno int) []Instruction {
 	}}
 }
 
+// ParseSLLI parses the SLLI pseudo-instruction
+func ParseSLLI(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	ra, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	rb, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	imm, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	count, err := strconv.ParseUint(imm, 0, 32)
+	if err != nil || count >= 32 {
+		return NewParseError(fmt.Errorf("%w for shift amount on line %d",
+			ErrOutOfRange, lineno))
+	}
+	// SLLI translates to a sequence of ADDs, each of which doubles the
+	// value, so `slli rA rB N` takes N words (one word when N is zero).
+	if count == 0 {
+		return []Instruction{InstructionADD{
+			Lineno:     lineno,
+			MaybeLabel: label,
+			RA:         ra,
+			RB:         rb,
+		}}
+	}
+	out := []Instruction{InstructionADD{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		RA:         ra,
+		RB:         rb,
+		RC:         rb,
+	}}
+	for i := uint64(1); i < count; i++ {
+		out = append(out, InstructionADD{
+			Lineno:     lineno,
+			MaybeLabel: nil, // no label for subsequent instructions
+			RA:         ra,
+			RB:         ra,
+			RC:         ra,
+		})
+	}
+	return out
+}
+
+// ParseSRLI parses the SRLI pseudo-instruction. Because the ISA does
+// not have any instruction shifting bits to the right, we cannot map
+// SRLI onto a short sequence of native instructions, hence we reject it.
+func ParseSRLI(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	return NewParseError(fmt.Errorf(
+		"%w: srli on line %d: the ISA cannot shift right", ErrNotSupported, lineno))
+}
+
+// ParseNOT parses the NOT pseudo-instruction
+func ParseNOT(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	ra, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	rb, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	return []Instruction{InstructionNOT{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		RA:         ra,
+		RB:         rb,
+	}}
+}
+
+// ParseMOV parses the MOV pseudo-instruction
+func ParseMOV(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	ra, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	rb, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	// MOV is mapped to ADD RA RB r0
+	return []Instruction{InstructionADD{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		RA:         ra,
+		RB:         rb,
+	}}
+}
+
+// ParseCALL parses the CALL pseudo-instruction
+func ParseCALL(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	imm, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	// CALL translates to MOVI into the temporary register followed
+	// by JALR saving the return address into the link register
+	return []Instruction{
+		InstructionLUI{
+			Lineno:     lineno,
+			MaybeLabel: label,
+			RA:         RegisterTemporary,
+			Imm:        imm,
+		},
+		InstructionLLI{
+			Lineno:     lineno,
+			MaybeLabel: nil, // no label for second instruction
+			RA:         RegisterTemporary,
+			Imm:        imm,
+		},
+		InstructionJALR{
+			Lineno:     lineno,
+			MaybeLabel: nil, // no label for third instruction
+			RA:         RegisterLink,
+			RB:         RegisterTemporary,
+		},
+	}
+}
+
+// ParseJAL parses the JAL pseudo-instruction, which jumps to label saving
+// the return address into rA. Like CALL, JAL uses the temporary register
+// as scratch register to hold the address of label, hence rA cannot be the
+// temporary register. When rA is the link register, JAL is like CALL.
+func ParseJAL(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	ra, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	imm, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	if ra == RegisterTemporary {
+		return NewParseError(fmt.Errorf("%w: cannot use r%d as link register on line %d",
+			ErrReservedRegister, RegisterTemporary, lineno))
+	}
+	// JAL translates to MOVI into the temporary register followed
+	// by JALR saving the return address into rA
+	return []Instruction{
+		InstructionLUI{
+			Lineno:     lineno,
+			MaybeLabel: label,
+			RA:         RegisterTemporary,
+			Imm:        imm,
+		},
+		InstructionLLI{
+			Lineno:     lineno,
+			MaybeLabel: nil, // no label for second instruction
+			RA:         RegisterTemporary,
+			Imm:        imm,
+		},
+		InstructionJALR{
+			Lineno:     lineno,
+			MaybeLabel: nil, // no label for third instruction
+			RA:         ra,
+			RB:         RegisterTemporary,
+		},
+	}
+}
+
+// ParsePCREL parses the PCREL pseudo-instruction, which loads into rA
+// the offset of label relative to the address of the PCREL itself. Since
+// the offset does not depend on where the code is loaded, one can add it to
+// the runtime address of the PCREL to compute the address of label in code
+// that the kernel relocates or remaps using paging. Like MOVI, PCREL uses
+// LUI and LLI, hence the offset may be any 32-bit value, while, e.g., BEQ
+// only reaches 17-bit offsets and LUI alone only loads the upper 22 bits.
+func ParsePCREL(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	ra, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	imm, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	// PCREL translates to LUI and LLI of the offset of label
+	return []Instruction{
+		InstructionPCREL{
+			Lineno:     lineno,
+			MaybeLabel: label,
+			RA:         ra,
+			Imm:        imm,
+		},
+		InstructionPCREL{
+			Lineno:     lineno,
+			MaybeLabel: nil, // no label for second instruction
+			RA:         ra,
+			Imm:        imm,
+			Low:        true,
+		},
+	}
+}
+
+// ParseRET parses the RET pseudo-instruction
+func ParseRET(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	// RET is mapped to JALR r0 r31
+	return []Instruction{InstructionJALR{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		RB:         RegisterLink,
+	}}
+}
+
+// ParseAND parses the AND pseudo-instruction. AND expands to two
+// NANDs and clobbers the assembler temporary register:
+//
+//     nand r1 rB rC
+//     nand rA r1 r1
+func ParseAND(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	ra, rb, rc, err := parseLogicalOperands(in, lineno)
+	if err != nil {
+		return NewParseError(err)
+	}
+	return []Instruction{
+		InstructionNAND{
+			Lineno:     lineno,
+			MaybeLabel: label,
+			RA:         RegisterTemporary,
+			RB:         rb,
+			RC:         rc,
+		},
+		InstructionNAND{
+			Lineno: lineno,
+			RA:     ra,
+			RB:     RegisterTemporary,
+			RC:     RegisterTemporary,
+		},
+	}
+}
+
+// ParseOR parses the OR pseudo-instruction. OR expands to three NANDs,
+// clobbers the assembler temporary register, and uses rA as the second
+// scratch register, which is safe even when rA is also an operand:
+//
+//     nand r1 rB rB
+//     nand rA rC rC
+//     nand rA r1 rA
+func ParseOR(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	ra, rb, rc, err := parseLogicalOperands(in, lineno)
+	if err != nil {
+		return NewParseError(err)
+	}
+	return []Instruction{
+		InstructionNAND{
+			Lineno:     lineno,
+			MaybeLabel: label,
+			RA:         RegisterTemporary,
+			RB:         rb,
+			RC:         rb,
+		},
+		InstructionNAND{
+			Lineno: lineno,
+			RA:     ra,
+			RB:     rc,
+			RC:     rc,
+		},
+		InstructionNAND{
+			Lineno: lineno,
+			RA:     ra,
+			RB:     RegisterTemporary,
+			RC:     ra,
+		},
+	}
+}
+
+// ParseXOR parses the XOR pseudo-instruction. XOR expands to four NANDs,
+// clobbers the assembler temporary register, and uses rA as the second
+// scratch register. We read rC before writing rA, hence, when rA is the
+// same register of rC, we swap the roles of rB and rC:
+//
+//     nand r1 rB rC
+//     nand rA rB r1
+//     nand r1 rC r1
+//     nand rA rA r1
+//
+// When rA, rB, and rC are the same register the result is always zero and
+// XOR expands to a single `add rA r0 r0` instruction.
+func ParseXOR(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	ra, rb, rc, err := parseLogicalOperands(in, lineno)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if ra == rb && rb == rc {
+		return []Instruction{InstructionADD{
+			Lineno:     lineno,
+			MaybeLabel: label,
+			RA:         ra,
+		}}
+	}
+	if ra == rc {
+		rb, rc = rc, rb
+	}
+	return []Instruction{
+		InstructionNAND{
+			Lineno:     lineno,
+			MaybeLabel: label,
+			RA:         RegisterTemporary,
+			RB:         rb,
+			RC:         rc,
+		},
+		InstructionNAND{
+			Lineno: lineno,
+			RA:     ra,
+			RB:     rb,
+			RC:     RegisterTemporary,
+		},
+		InstructionNAND{
+			Lineno: lineno,
+			RA:     RegisterTemporary,
+			RB:     rc,
+			RC:     RegisterTemporary,
+		},
+		InstructionNAND{
+			Lineno: lineno,
+			RA:     ra,
+			RB:     ra,
+			RC:     RegisterTemporary,
+		},
+	}
+}
+
+// parseLogicalOperands parses the operands of the AND, OR, and XOR
+// pseudo-instructions, which cannot use the temporary register.
+func parseLogicalOperands(
+	in <-chan LexerToken, lineno int) (ra, rb, rc uint32, err error) {
+	if ra, err = ParseRegister(in); err != nil {
+		return
+	}
+	if rb, err = ParseRegister(in); err != nil {
+		return
+	}
+	if rc, err = ParseRegister(in); err != nil {
+		return
+	}
+	if err = ParseEOL(in); err != nil {
+		return
+	}
+	if ra == RegisterTemporary || rb == RegisterTemporary || rc == RegisterTemporary {
+		err = fmt.Errorf("%w: cannot use r%d as operand on line %d",
+			ErrReservedRegister, RegisterTemporary, lineno)
+	}
+	return
+}
+
+// ParseBNE parses the BNE pseudo-instruction. BNE expands to a BEQ that
+// skips over the following unconditional branch to the target:
+//
+//     beq rA rB 1   # PC-relative: skip the next instruction
+//     beq r0 r0 label
+func ParseBNE(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	ra, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	rb, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	imm, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	return []Instruction{
+		InstructionBEQ{
+			Lineno:     lineno,
+			MaybeLabel: label,
+			RA:         ra,
+			RB:         rb,
+			Imm:        "1",
+			Relative:   true,
+		},
+		InstructionBEQ{
+			Lineno:     lineno,
+			MaybeLabel: nil, // no label for second instruction
+			Imm:        imm,
+		},
+	}
+}
+
+// ParseJMP parses the JMP pseudo-instruction
+func ParseJMP(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	imm, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	// JMP is mapped to BEQ r0 r0 label
+	return []Instruction{InstructionBEQ{
+		Lineno:     lineno,
+		MaybeLabel: label,
+		Imm:        imm,
+	}}
+}
+
+// ParseMUL parses the MUL pseudo-instruction. MUL computes the product
+// of rB and rC truncated to 32 bits by calling the __rt_mul runtime routine
+// (see RuntimeRoutines), thus it takes 13 words, clobbers r1, and uses
+// eight words of the stack pointed by r29, which must be valid.
+func ParseMUL(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	ra, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	rb, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	rc, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	return NewRuntimeCall(label, lineno, "__rt_mul", ra, rb, rc)
+}
+
+// ParseLB parses the LB pseudo-instruction, which loads into rA the byte
+// at the byte address contained by rB, i.e., the byte rB & 3 of the word
+// at rB >> 2, where byte zero is the least significant one. LB calls the
+// __rt_lb runtime routine (see RuntimeRoutines), takes 11 words, clobbers
+// r1, and uses eight words of the stack pointed by r29, which must be valid.
+func ParseLB(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	ra, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	rb, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	return NewRuntimeCall(label, lineno, "__rt_lb", ra, rb)
+}
+
+// ParseSB parses the SB pseudo-instruction, which stores the low byte of
+// rA at the byte address contained by rB (see ParseLB). SB calls the
+// __rt_sb runtime routine, takes 13 words, clobbers r1, and uses nine
+// words of the stack pointed by r29, which must be valid.
+func ParseSB(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	ra, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	rb, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	return NewRuntimeCall(label, lineno, "__rt_sb", RegisterTemporary, ra, rb)
+}
+
+// ParseLI parses the LI pseudo-instruction. When imm is a number that
+// fits into 17 signed bits, LI translates to ADDI rA r0 imm, which takes
+// a single word. Otherwise, LI translates to MOVI, which takes two words.
+// Because we choose the encoding while parsing, when imm is the name of a
+// label or constant, we always use MOVI, since we don't know its value yet.
+func ParseLI(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	ra, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	imm, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	if value, err := strconv.ParseInt(imm, 0, 64); err == nil {
+		if _, err := CastToUint32(value, 17, lineno); err == nil {
+			return []Instruction{InstructionADDI{
+				Lineno:     lineno,
+				MaybeLabel: label,
+				RA:         ra,
+				RB:         0,
+				Imm:        imm,
+			}}
+		}
+	}
+	return []Instruction{
+		InstructionLUI{
+			Lineno:     lineno,
+			MaybeLabel: label,
+			RA:         ra,
+			Imm:        imm,
+		},
+		InstructionLLI{
+			Lineno:     lineno,
+			MaybeLabel: nil, // no label for second instruction
+			RA:         ra,
+			Imm:        imm,
+		},
+	}
+}
+
 // ParseRegister parses a register.
 func ParseRegister(in <-chan LexerToken) (uint32, error) {
 	token := <-in
@@ -495,26 +1337,38 @@ func ParseRegister(in <-chan LexerToken) (uint32, error) {
 		return 0, fmt.Errorf("%w while parsing register name on line %d",
 			ErrExpectedNameOrNumber, token.Lineno)
 	}
-	if !strings.HasPrefix(token.Value, "r") {
-		return 0, fmt.Errorf("%w while parsing register name '%s' on line %d",
-			ErrInvalidRegisterName, token.Value, token.Lineno)
+	if rid, found := RegisterAliases[token.Value]; found {
+		return rid, nil
 	}
+	// Note: we only accept decimal register numbers between 0 and 31,
+	// so that, e.g., `r-1`, `r0x1`, and `r32` are all invalid.
 	v := strings.TrimPrefix(token.Value, "r")
 	rid, err := strconv.ParseUint(v, 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("%w: %s", ErrInvalidRegisterName, err.Error())
-	}
-	if rid >= 32 {
-		return 0, fmt.Errorf("%w: register ID greater than 32", ErrInvalidRegisterName)
+	if !strings.HasPrefix(token.Value, "r") || err != nil || rid >= spec.NumRegisters {
+		return 0, fmt.Errorf("%w '%s' on line %d: expected r0 ... r%d",
+			ErrInvalidRegisterName, token.Value, token.Lineno, spec.NumRegisters-1)
 	}
 	return uint32(rid), nil
 }
 
-// ParseImmediate parses an immediate.
+// ParseImmediate parses an immediate. A character literal, e.g., 'A'
+// or '\n', is converted to the decimal value of the character.
 func ParseImmediate(in <-chan LexerToken) (string, error) {
-	token := <-in
+	return immediateValue(<-in)
+}
+
+// immediateValue returns the value of the immediate token.
+func immediateValue(token LexerToken) (string, error) {
 	switch token.Type {
 	case LexerNameOrNumber:
+	case LexerCharacter:
+		value, _, tail, err := strconv.UnquoteChar(
+			strings.TrimSuffix(strings.TrimPrefix(token.Value, "'"), "'"), '\'')
+		if err != nil || tail != "" || value > 0xff {
+			return "", fmt.Errorf("%w: invalid character %s on line %d",
+				ErrOutOfRange, token.Value, token.Lineno)
+		}
+		return strconv.Itoa(int(value)), nil
 	default:
 		return "", fmt.Errorf("%w while parsing immediate on line %d",
 			ErrExpectedNameOrNumber, token.Lineno)
@@ -533,3 +1387,54 @@ func ParseEOL(in <-chan LexerToken) error {
 			ErrExpectedEOL, token.Lineno)
 	}
 }
+
+// ParseBLT parses the BLT pseudo-instruction. BLT branches to the target
+// when rA is less than rB, interpreting both as signed numbers. To this end,
+// it calls the __rt_slt runtime routine (see RuntimeRoutines), which stores
+// the result of the comparison into r1, and then it branches using BNE:
+//
+//     ...               # call __rt_slt (13 words)
+//     beq r1 r0 1       # PC-relative: skip the next instruction
+//     beq r0 r0 label
+//
+// Thus, BLT takes 15 words, clobbers r1, and uses eight words of the stack
+// pointed by r29, which must be valid.
+func ParseBLT(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	return parseLessThan(in, label, lineno, "__rt_slt")
+}
+
+// ParseBLTU parses the BLTU pseudo-instruction. BLTU is like BLT except
+// that it interprets rA and rB as unsigned numbers and calls __rt_sltu.
+func ParseBLTU(in <-chan LexerToken, label *string, lineno int) []Instruction {
+	return parseLessThan(in, label, lineno, "__rt_sltu")
+}
+
+// parseLessThan parses BLT or BLTU using the specified routine.
+func parseLessThan(
+	in <-chan LexerToken, label *string, lineno int, routine string) []Instruction {
+	ra, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	rb, err := ParseRegister(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	imm, err := ParseImmediate(in)
+	if err != nil {
+		return NewParseError(err)
+	}
+	if err := ParseEOL(in); err != nil {
+		return NewParseError(err)
+	}
+	out := NewRuntimeCall(label, lineno, routine, RegisterTemporary, ra, rb)
+	return append(out, InstructionBEQ{
+		Lineno:   lineno,
+		RA:       RegisterTemporary,
+		Imm:      "1",
+		Relative: true,
+	}, InstructionBEQ{
+		Lineno: lineno,
+		Imm:    imm,
+	})
+}
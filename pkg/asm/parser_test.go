@@ -0,0 +1,378 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestLIChoosesTheEncoding(t *testing.T) {
+	out := assemble(t, lines(
+		"start: li r1 5",
+		"       li r2 -65536",
+		"big:   li r3 65536",
+		"       li r4 0x12345678",
+		"       li r5 done",
+		"done:  halt",
+	))
+	expect := map[string]uint32{"start": 0, "big": 2, "done": 8}
+	for name, addr := range expect {
+		if out.labels[name] != addr {
+			t.Fatalf("%s: expected 0x%x, got 0x%x", name, addr, out.labels[name])
+		}
+	}
+	if len(out.words) != 9 {
+		t.Fatalf("expected 9 words, got %d", len(out.words))
+	}
+	if out.words[0] != 0x10400005 || out.words[1] != 0x10810000 {
+		t.Fatalf("expected one-word addi, got 0x%08x 0x%08x", out.words[0], out.words[1])
+	}
+	machine := runWords(t, out.words)
+	for reg, value := range map[int]uint32{
+		1: 5, 2: 0xffff0000, 3: 65536, 4: 0x12345678, 5: 8,
+	} {
+		if machine.GPR[reg] != value {
+			t.Fatalf("r%d: expected 0x%x, got 0x%x", reg, value, machine.GPR[reg])
+		}
+	}
+}
+
+func TestSLLI(t *testing.T) {
+	for _, value := range []uint32{0, 1, 5, 0x12345678, 0xfffffffd} {
+		out := assemble(t, lines(
+			fmt.Sprintf("movi r2 %d", value),
+			"slli r1 r2 3",
+			"slli r3 r2 0",
+			"slli r4 r2 31",
+			"halt",
+		))
+		machine := runWords(t, out.words)
+		if machine.GPR[1] != value*8 {
+			t.Fatalf("%d << 3: expected 0x%x, got 0x%x", value, value*8, machine.GPR[1])
+		}
+		if machine.GPR[3] != value || machine.GPR[4] != value<<31 {
+			t.Fatalf("%d: unexpected r3=0x%x r4=0x%x", value, machine.GPR[3], machine.GPR[4])
+		}
+	}
+	if err := assembleError(t, lines("slli r1 r2 32")); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("expected ErrOutOfRange, got %v", err)
+	}
+	if err := assembleError(t, lines("srli r1 r2 3")); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+	if err := assembleError(t, lines("srli r1 r2")); !errors.Is(err, ErrOperandCount) {
+		t.Fatalf("expected ErrOperandCount, got %v", err)
+	}
+}
+
+func TestNOT(t *testing.T) {
+	for _, value := range []uint32{0, 1, 0x12345678, 0xffffffff} {
+		out := assemble(t, lines(
+			fmt.Sprintf("movi r2 %d", value),
+			"not r3 r2",
+			"mov r4 r2",
+			"not r4 r4", // in place
+			"halt",
+		))
+		if len(out.words) != 6 { // movi takes two words
+			t.Fatalf("expected not to take one word, got %d words", len(out.words))
+		}
+		machine := runWords(t, out.words)
+		if machine.GPR[3] != ^value || machine.GPR[4] != ^value || machine.GPR[2] != value {
+			t.Fatalf("^0x%x: unexpected r2=0x%x r3=0x%x r4=0x%x", value,
+				machine.GPR[2], machine.GPR[3], machine.GPR[4])
+		}
+	}
+}
+
+func TestMOV(t *testing.T) {
+	out := assemble(t, lines(
+		"movi r2 0xdeadbeef",
+		"mov r3 r2",
+		"mov r4 r0",
+		"addi r5 r0 7",
+		"mov r5 r5", // no-op
+		"mov r31 r3",
+		"halt",
+	))
+	if out.words[2] != 0x08c40000 { // add r3 r2 r0
+		t.Fatalf("unexpected mov encoding: 0x%08x", out.words[2])
+	}
+	machine := runWords(t, out.words)
+	for reg, value := range map[int]uint32{
+		2: 0xdeadbeef, 3: 0xdeadbeef, 4: 0, 5: 7, 31: 0xdeadbeef,
+	} {
+		if machine.GPR[reg] != value {
+			t.Fatalf("r%d: expected 0x%x, got 0x%x", reg, value, machine.GPR[reg])
+		}
+	}
+}
+
+func TestCALLAndRET(t *testing.T) {
+	out := assemble(t, lines(
+		"        addi r2 r0 1",
+		"        call double",
+		"back1:  call double",
+		"back2:  halt",
+		"double: add r2 r2 r2",
+		"        add r4 r3 r0",  // the previous return address
+		"        add r3 r31 r0", // the return address
+		"        ret",
+	))
+	if out.labels["back1"] != 4 || out.labels["back2"] != 7 {
+		t.Fatalf("expected call to take three words: %+v", out.labels)
+	}
+	machine := runWords(t, out.words)
+	if machine.GPR[2] != 4 {
+		t.Fatalf("expected r2=4, got %d", machine.GPR[2])
+	}
+	if machine.GPR[4] != out.labels["back1"] || machine.GPR[3] != out.labels["back2"] ||
+		machine.GPR[31] != out.labels["back2"] {
+		t.Fatalf("unexpected return addresses: r4=%d r3=%d r31=%d",
+			machine.GPR[4], machine.GPR[3], machine.GPR[31])
+	}
+	if machine.GPR[1] != out.labels["double"] {
+		t.Fatalf("expected r1 to contain the callee, got %d", machine.GPR[1])
+	}
+}
+
+func TestLogicalOperations(t *testing.T) {
+	var table = []struct {
+		a, b uint32
+	}{
+		{0x3, 0x5}, // all the combinations of two bits
+		{0xffff0000, 0x0ff00ff0},
+		{0xffffffff, 0},
+		{0x12345678, 0x12345678},
+	}
+	for _, entry := range table {
+		out := assemble(t, lines(
+			fmt.Sprintf("movi r2 %d", entry.a),
+			fmt.Sprintf("movi r3 %d", entry.b),
+			"and r4 r2 r3",
+			"or r5 r2 r3",
+			"xor r6 r2 r3",
+			"mov r7 r2",
+			"and r7 r7 r3", // rA is rB
+			"mov r8 r3",
+			"or r8 r2 r8", // rA is rC
+			"mov r9 r3",
+			"xor r9 r2 r9", // rA is rC
+			"mov r10 r2",
+			"xor r10 r10 r10", // rA, rB, and rC are the same
+			"halt",
+		))
+		machine := runWords(t, out.words)
+		and, or, xor := entry.a&entry.b, entry.a|entry.b, entry.a^entry.b
+		for reg, value := range map[int]uint32{
+			4: and, 5: or, 6: xor, 7: and, 8: or, 9: xor, 10: 0,
+			2: entry.a, 3: entry.b,
+		} {
+			if machine.GPR[reg] != value {
+				t.Fatalf("0x%x, 0x%x: r%d: expected 0x%x, got 0x%x",
+					entry.a, entry.b, reg, value, machine.GPR[reg])
+			}
+		}
+	}
+	for _, source := range []string{"and r1 r2 r3", "or r2 r1 r3", "xor r2 r3 r1"} {
+		if err := assembleError(t, lines(source)); !errors.Is(err, ErrReservedRegister) {
+			t.Fatalf("%s: expected ErrReservedRegister, got %v", source, err)
+		}
+	}
+}
+
+func TestBNE(t *testing.T) {
+	var table = []struct {
+		a, b  uint32
+		taken bool
+	}{
+		{0, 0, false},
+		{7, 7, false},
+		{7, 8, true},
+		{0xffffffff, 0, true},
+	}
+	for _, entry := range table {
+		out := assemble(t, lines(
+			fmt.Sprintf("        movi r2 %d", entry.a),
+			fmt.Sprintf("        movi r3 %d", entry.b),
+			"        bne r2 r3 taken",
+			"        addi r4 r0 1",
+			"        halt",
+			"taken:  addi r4 r0 2",
+			"        halt",
+		))
+		expect := uint32(1)
+		if entry.taken {
+			expect = 2
+		}
+		if machine := runWords(t, out.words); machine.GPR[4] != expect {
+			t.Fatalf("%d != %d: expected r4=%d, got %d", entry.a, entry.b, expect, machine.GPR[4])
+		}
+	}
+	out := assemble(t, lines(
+		"        addi r2 r0 10",
+		"loop:   addi r3 r3 1",
+		"        addi r2 r2 -1",
+		"        bne r2 r0 loop", // backward
+		"        halt",
+	))
+	if machine := runWords(t, out.words); machine.GPR[2] != 0 || machine.GPR[3] != 10 {
+		t.Fatalf("unexpected loop result: r2=%d r3=%d", machine.GPR[2], machine.GPR[3])
+	}
+}
+
+func TestJMP(t *testing.T) {
+	out := assemble(t, lines(
+		"        jmp fwd",
+		"        addi r2 r0 1", // skipped
+		"back:   addi r3 r0 3",
+		"        halt",
+		"fwd:    addi r4 r0 4",
+		"        jmp back",
+	))
+	machine := runWords(t, out.words)
+	if machine.GPR[2] != 0 || machine.GPR[3] != 3 || machine.GPR[4] != 4 {
+		t.Fatalf("unexpected result: r2=%d r3=%d r4=%d",
+			machine.GPR[2], machine.GPR[3], machine.GPR[4])
+	}
+	// the offset is relative to the following instruction and
+	// must fit into 17 signed bits
+	if out := assemble(t, lines("jmp far", ".space 65535", "far: halt")); out.words[0] != 0x3800ffff {
+		t.Fatalf("unexpected encoding: 0x%08x", out.words[0])
+	}
+	if out := assemble(t, lines("back: .space 65535", "jmp back")); out.words[65535] != 0x38010000 {
+		t.Fatalf("unexpected encoding: 0x%08x", out.words[65535])
+	}
+	for _, source := range []string{
+		lines("jmp far", ".space 65536", "far: halt"),
+		lines("back: .space 65536", "jmp back"),
+	} {
+		if err := assembleError(t, source); !errors.Is(err, ErrOutOfRange) {
+			t.Fatalf("expected ErrOutOfRange, got %v", err)
+		}
+	}
+}
+
+func TestMUL(t *testing.T) {
+	var table = []struct {
+		a, b uint32
+	}{
+		{0, 12345},
+		{1, 0xffffffff},
+		{6, 7},
+		{0xffffffff, 0xffffffff}, // -1 * -1
+		{0xfffffffd, 5},          // -3 * 5
+		{0x12345678, 0x9abcdef0}, // truncated
+		{1 << 31, 2},             // truncated to zero
+	}
+	for _, entry := range table {
+		out := assemble(t, lines(
+			"        movi $sp stack",
+			fmt.Sprintf("        movi r2 %d", entry.a),
+			fmt.Sprintf("        movi r3 %d", entry.b),
+			"        mul r4 r2 r3",
+			"        mov r5 r2",
+			"        mul r5 r5 r5",
+			"        halt",
+			"        .space 16",
+			"stack:  .fill 0",
+		))
+		machine := runWords(t, out.words)
+		if expect := entry.a * entry.b; machine.GPR[4] != expect {
+			t.Fatalf("0x%x * 0x%x: expected 0x%x, got 0x%x", entry.a, entry.b, expect, machine.GPR[4])
+		}
+		if expect := entry.a * entry.a; machine.GPR[5] != expect {
+			t.Fatalf("0x%x squared: expected 0x%x, got 0x%x", entry.a, expect, machine.GPR[5])
+		}
+		if machine.GPR[2] != entry.a || machine.GPR[3] != entry.b {
+			t.Fatalf("mul clobbered its operands: r2=0x%x r3=0x%x", machine.GPR[2], machine.GPR[3])
+		}
+		if machine.GPR[29] != out.labels["stack"] {
+			t.Fatalf("unbalanced stack: r29=0x%x", machine.GPR[29])
+		}
+	}
+}
+
+func TestBLTAndBLTU(t *testing.T) {
+	var table = []struct {
+		a, b    uint32
+		lt, ltu bool
+	}{
+		{1, 2, true, true},
+		{2, 1, false, false},
+		{5, 5, false, false},
+		{0xffffffff, 0xffffffff, false, false}, // equal negatives
+		{0xffffffff, 1, true, false},           // -1 < 1
+		{1, 0xffffffff, false, true},
+		{0x80000000, 0x7fffffff, true, false}, // min < max
+		{0xfffffffe, 0xffffffff, true, true},  // -2 < -1
+	}
+	for _, entry := range table {
+		out := assemble(t, lines(
+			"        movi $sp stack",
+			fmt.Sprintf("        movi r2 %d", entry.a),
+			fmt.Sprintf("        movi r3 %d", entry.b),
+			"        blt r2 r3 lt",
+			"back:   bltu r2 r3 ltu",
+			"        halt",
+			"lt:     addi r4 r0 1",
+			"        jmp back",
+			"ltu:    addi r5 r0 1",
+			"        halt",
+			"        .space 16",
+			"stack:  .fill 0",
+		))
+		machine := runWords(t, out.words)
+		if lt := machine.GPR[4] == 1; lt != entry.lt {
+			t.Fatalf("blt 0x%x 0x%x: expected %v, got %v", entry.a, entry.b, entry.lt, lt)
+		}
+		if ltu := machine.GPR[5] == 1; ltu != entry.ltu {
+			t.Fatalf("bltu 0x%x 0x%x: expected %v, got %v", entry.a, entry.b, entry.ltu, ltu)
+		}
+	}
+}
+
+func TestLBAndSB(t *testing.T) {
+	out := assemble(t, lines(
+		"        movi $sp stack",
+		"        movi r2 word1",
+		"        slli r2 r2 2", // byte address of word1
+		"        lb r10 r2",
+		"        addi r2 r2 1",
+		"        lb r11 r2",
+		"        addi r2 r2 1",
+		"        lb r12 r2",
+		"        addi r2 r2 1",
+		"        lb r13 r2",
+		"        movi r2 word2",
+		"        slli r2 r2 2",     // byte address of word2
+		"        addi r3 r0 0x1a1", // only the low byte is stored
+		"        sb r3 r2",
+		"        addi r2 r2 1",
+		"        addi r3 r0 0xa2",
+		"        sb r3 r2",
+		"        addi r2 r2 2", // skip a byte
+		"        addi r3 r0 0xa4",
+		"        sb r3 r2",
+		"        movi r2 word2",
+		"        lw r14 r2 0",
+		"        lw r15 r2 1", // word3
+		"        halt",
+		"word1:  .fill 0x11223344",
+		"word2:  .fill 0x55667788",
+		"word3:  .fill 0x99aabbcc",
+		"        .space 16",
+		"stack:  .fill 0",
+	))
+	machine := runWords(t, out.words)
+	for reg, value := range map[int]uint32{
+		10: 0x44, 11: 0x33, 12: 0x22, 13: 0x11, 14: 0xa466a2a1, 15: 0x99aabbcc,
+	} {
+		if machine.GPR[reg] != value {
+			t.Fatalf("r%d: expected 0x%x, got 0x%x", reg, value, machine.GPR[reg])
+		}
+	}
+	if machine.GPR[29] != out.labels["stack"] {
+		t.Fatalf("unbalanced stack: r29=0x%x", machine.GPR[29])
+	}
+}
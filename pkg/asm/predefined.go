@@ -0,0 +1,48 @@
+package asm
+
+import "github.com/bassosimone/risc32/pkg/spec"
+
+// PredefinedConstants contains the constants of the ISA that programs
+// may reference by name, e.g., `addi r8 r0 StatusInterrupts`. A program
+// may override any of them using a label or the .equ directive.
+var PredefinedConstants = map[string]int64{
+	// status register flags
+	"StatusUserMode":      spec.StatusUserMode,
+	"StatusPaging":        spec.StatusPaging,
+	"StatusInterrupts":    spec.StatusInterrupts,
+	"StatusDebugStepping": spec.StatusDebugStepping,
+	"StatusDebugTracing":  spec.StatusDebugTracing,
+
+	// page table entry flags
+	"MemoryExec":     spec.MemoryExec,
+	"MemoryWrite":    spec.MemoryWrite,
+	"MemoryRead":     spec.MemoryRead,
+	"MemoryAccessed": spec.MemoryAccessed,
+	"MemoryDirty":    spec.MemoryDirty,
+
+	// interrupts
+	"IrqHALT":      spec.IrqHALT,
+	"IrqClock":     spec.IrqClock,
+	"IrqTTY":       spec.IrqTTY,
+	"IrqDisk":      spec.IrqDisk,
+	"IrqPageFault": spec.IrqPageFault,
+
+	// memory mapped I/O
+	"MMClockFrequency": spec.MMClockFrequency,
+	"MMTTYStatus":      spec.MMTTYStatus,
+	"MMTTYIn":          spec.MMTTYIn,
+	"MMTTYOut":         spec.MMTTYOut,
+	"MMDiskSector":     spec.MMDiskSector,
+	"MMDiskBuffer":     spec.MMDiskBuffer,
+	"MMDiskControl":    spec.MMDiskControl,
+	"MMClockTicks":     spec.MMClockTicks,
+
+	// devices
+	"ClockOneShot": spec.ClockOneShot,
+	"TTYIn":        spec.TTYIn,
+	"TTYOut":       spec.TTYOut,
+	"DiskRead":     spec.DiskRead,
+	"DiskWrite":    spec.DiskWrite,
+	"DiskDone":     spec.DiskDone,
+	"DiskError":    spec.DiskError,
+}
@@ -0,0 +1,265 @@
+package asm
+
+import (
+	"strconv"
+)
+
+// RuntimeRoutines maps the label of each runtime routine to its source
+// code. Some pseudo-instructions expand to a call to a runtime routine. The
+// assembler appends the code of each referenced routine to the end of the
+// program, exactly once, so that only used routines take space.
+//
+// The calling convention for runtime routines is as follows. The caller
+// pushes the arguments on the stack pointed by r29, which grows downward
+// and points to the first free word. Then, the caller pushes r31, loads the
+// routine address into r1, and calls it using r31 as the link register. The
+// routine stores its result in place of the first argument and preserves
+// every register but r1. Once the routine returns, the caller pops r31 and
+// the arguments, and loads the result into the destination register.
+var RuntimeRoutines = map[string]string{
+	"__rt_lb":   runtimeByte,
+	"__rt_mul":  runtimeMul,
+	"__rt_sb":   runtimeByte,
+	"__rt_slt":  runtimeLessThan,
+	"__rt_sltu": runtimeLessThan,
+}
+
+// runtimeMul computes the product of two 32-bit numbers truncated to
+// 32 bits using the shift-and-add algorithm.
+const runtimeMul = `
+__rt_mul:       sw r2 r29 0
+                addi r29 r29 -1
+                sw r3 r29 0
+                addi r29 r29 -1
+                sw r4 r29 0
+                addi r29 r29 -1
+                sw r5 r29 0
+                addi r29 r29 -1      # save r2, r3, r4, r5
+                lw r2 r29 7          # multiplicand
+                lw r3 r29 6          # multiplier
+                addi r4 r0 1         # mask of the current bit
+                add r5 r0 r0         # product
+__rt_mul_loop:  beq r4 r0 __rt_mul_done
+                nand r1 r3 r4
+                nand r1 r1 r1        # r1 = multiplier & mask
+                beq r1 r0 __rt_mul_next
+                add r5 r5 r2
+__rt_mul_next:  add r2 r2 r2
+                add r4 r4 r4
+                beq r0 r0 __rt_mul_loop
+__rt_mul_done:  sw r5 r29 7          # store the product
+                addi r29 r29 1
+                lw r5 r29 0
+                addi r29 r29 1
+                lw r4 r29 0
+                addi r29 r29 1
+                lw r3 r29 0
+                addi r29 r29 1
+                lw r2 r29 0          # restore r2, r3, r4, r5
+                jalr r0 r31
+`
+
+// runtimeLessThan computes whether the first argument is less than the
+// second one. The result is one when that is true and zero otherwise. The
+// __rt_sltu entry point compares unsigned numbers. The __rt_slt entry point
+// compares signed numbers by flipping their most significant bit, which
+// maps the signed range onto the unsigned range preserving the order. We
+// compare the bits of the two numbers starting from the most significant
+// one, until the remaining bits are equal or we find a different bit.
+const runtimeLessThan = `
+__rt_slt:       lui r1 -2147483648   # bias flipping the sign bit
+                beq r0 r0 __rt_lt
+__rt_sltu:      add r1 r0 r0         # no bias
+__rt_lt:        sw r2 r29 0
+                addi r29 r29 -1
+                sw r3 r29 0
+                addi r29 r29 -1
+                sw r4 r29 0
+                addi r29 r29 -1
+                sw r5 r29 0
+                addi r29 r29 -1
+                sw r6 r29 0
+                addi r29 r29 -1      # save r2, r3, r4, r5, r6
+                lw r2 r29 8          # first operand
+                lw r3 r29 7          # second operand
+                add r2 r2 r1
+                add r3 r3 r1         # apply the bias
+                lui r4 -2147483648   # mask of the most significant bit
+                add r5 r0 r0         # result
+__rt_lt_loop:   beq r2 r3 __rt_lt_done
+                nand r1 r2 r4
+                nand r1 r1 r1        # r1 = first operand & mask
+                nand r6 r3 r4
+                nand r6 r6 r6        # r6 = second operand & mask
+                beq r1 r6 __rt_lt_next
+                bne r1 r0 __rt_lt_done
+                addi r5 r0 1         # first operand bit is zero, so less
+                beq r0 r0 __rt_lt_done
+__rt_lt_next:   add r2 r2 r2
+                add r3 r3 r3
+                beq r0 r0 __rt_lt_loop
+__rt_lt_done:   sw r5 r29 8          # store the result
+                addi r29 r29 1
+                lw r6 r29 0
+                addi r29 r29 1
+                lw r5 r29 0
+                addi r29 r29 1
+                lw r4 r29 0
+                addi r29 r29 1
+                lw r3 r29 0
+                addi r29 r29 1
+                lw r2 r29 0          # restore r2, r3, r4, r5, r6
+                jalr r0 r31
+`
+
+// runtimeByte loads or stores a byte. The __rt_lb entry point takes the
+// byte address and returns the byte. The __rt_sb entry point takes the
+// value, whose low byte it stores, and the byte address. Memory is word
+// addressed, so the byte address B refers to the byte B & 3 of the word
+// at B >> 2, where byte zero is the least significant one. Since the ISA
+// cannot shift right, we compute B >> 2 by copying bits one by one.
+const runtimeByte = `
+__rt_lb:        add r1 r0 r0         # we are loading
+                beq r0 r0 __rt_byte
+__rt_sb:        addi r1 r0 1         # we are storing
+__rt_byte:      sw r2 r29 0
+                addi r29 r29 -1
+                sw r3 r29 0
+                addi r29 r29 -1
+                sw r4 r29 0
+                addi r29 r29 -1
+                sw r5 r29 0
+                addi r29 r29 -1
+                sw r6 r29 0
+                addi r29 r29 -1
+                sw r7 r29 0
+                addi r29 r29 -1      # save r2, r3, r4, r5, r6, r7
+                add r6 r0 r1         # whether we are storing
+                lw r2 r29 8          # byte address
+                addi r4 r0 4         # mask of the current byte address bit
+                addi r5 r0 1         # mask of the current word address bit
+                add r3 r0 r0         # word address
+__rt_bw_addr:   beq r4 r0 __rt_bw_off
+                nand r1 r2 r4
+                nand r1 r1 r1        # r1 = byte address & mask
+                beq r1 r0 __rt_bw_anext
+                add r3 r3 r5
+__rt_bw_anext:  add r4 r4 r4
+                add r5 r5 r5
+                beq r0 r0 __rt_bw_addr
+__rt_bw_off:    addi r1 r0 3
+                nand r2 r2 r1
+                nand r2 r2 r2        # byte offset
+                addi r4 r0 1         # mask of the lowest bit of the byte
+__rt_bw_shift:  beq r2 r0 __rt_bw_word
+                add r4 r4 r4
+                add r4 r4 r4
+                add r4 r4 r4
+                add r4 r4 r4
+                add r4 r4 r4
+                add r4 r4 r4
+                add r4 r4 r4
+                add r4 r4 r4
+                addi r2 r2 -1
+                beq r0 r0 __rt_bw_shift
+__rt_bw_word:   lw r7 r3 0           # word containing the byte
+                addi r2 r0 256       # stop after the eighth bit
+                addi r5 r0 1         # mask of the current value bit
+                beq r6 r0 __rt_lb_loop   # r6 is zero when loading
+                lw r6 r29 9          # value to store
+__rt_sb_loop:   beq r5 r2 __rt_sb_done
+                nand r1 r4 r4
+                nand r7 r7 r1
+                nand r7 r7 r7        # clear the bit of the word
+                nand r1 r6 r5
+                nand r1 r1 r1        # r1 = value & mask
+                beq r1 r0 __rt_sb_next
+                add r7 r7 r4         # set the bit of the word
+__rt_sb_next:   add r4 r4 r4
+                add r5 r5 r5
+                beq r0 r0 __rt_sb_loop
+__rt_sb_done:   sw r7 r3 0           # store the modified word
+                beq r0 r0 __rt_bw_done
+__rt_lb_loop:   beq r5 r2 __rt_lb_done
+                nand r1 r7 r4
+                nand r1 r1 r1        # r1 = word & mask
+                beq r1 r0 __rt_lb_next
+                add r6 r6 r5
+__rt_lb_next:   add r4 r4 r4
+                add r5 r5 r5
+                beq r0 r0 __rt_lb_loop
+__rt_lb_done:   sw r6 r29 8          # store the byte
+__rt_bw_done:   addi r29 r29 1
+                lw r7 r29 0
+                addi r29 r29 1
+                lw r6 r29 0
+                addi r29 r29 1
+                lw r5 r29 0
+                addi r29 r29 1
+                lw r4 r29 0
+                addi r29 r29 1
+                lw r3 r29 0
+                addi r29 r29 1
+                lw r2 r29 0          # restore r2, r3, r4, r5, r6, r7
+                jalr r0 r31
+`
+
+// NewRuntimeCall returns the instructions calling the specified runtime
+// routine with the specified arguments and storing the result into ra.
+func NewRuntimeCall(
+	label *string, lineno int, routine string, ra uint32, args ...uint32) []Instruction {
+	var out []Instruction
+	push := func(reg uint32) {
+		out = append(out, InstructionSW{
+			Lineno:     lineno,
+			MaybeLabel: label,
+			RA:         reg,
+			RB:         RegisterStack,
+			Imm:        "0",
+		}, InstructionADDI{
+			Lineno: lineno,
+			RA:     RegisterStack,
+			RB:     RegisterStack,
+			Imm:    "-1",
+		})
+		label = nil // only the first instruction has a label
+	}
+	for _, reg := range args {
+		push(reg)
+	}
+	push(RegisterLink)
+	out = append(out, InstructionLUI{
+		Lineno: lineno,
+		RA:     RegisterTemporary,
+		Imm:    routine,
+	}, InstructionLLI{
+		Lineno: lineno,
+		RA:     RegisterTemporary,
+		Imm:    routine,
+	}, InstructionJALR{
+		Lineno: lineno,
+		RA:     RegisterLink,
+		RB:     RegisterTemporary,
+	}, InstructionADDI{
+		Lineno: lineno,
+		RA:     RegisterStack,
+		RB:     RegisterStack,
+		Imm:    "1",
+	}, InstructionLW{
+		Lineno: lineno,
+		RA:     RegisterLink,
+		RB:     RegisterStack,
+		Imm:    "0",
+	}, InstructionADDI{
+		Lineno: lineno,
+		RA:     RegisterStack,
+		RB:     RegisterStack,
+		Imm:    strconv.Itoa(len(args)),
+	}, InstructionLW{
+		Lineno: lineno,
+		RA:     ra,
+		RB:     RegisterStack,
+		Imm:    "0",
+	})
+	return out
+}
@@ -0,0 +1,92 @@
+// Package spec contains the constants defining the RiSC-32 instruction
+// set architecture, which both the assembler and the VM use.
+package spec
+
+// The following constants define the opcodes. We have 5 bits to define
+// opcodes, so up to 32 opcodes. While the opcodes here are related to
+// the ones of RiSC-16, here we have more opcodes and also their values
+// aren't necessarily aligned with the RiSC-16 architecture ones.
+const (
+	// RiSC-16 like operations -- note that JALR is the first operation
+	// so that zero initialized memory stops the VM when we are not using
+	// interrupts, which is a quite handy feature. This is also why the
+	// HALT pseudo-instruction is encoded as `jalr r0 r0`.
+	OpcodeJALR = uint32(iota)
+
+	OpcodeADD
+	OpcodeADDI
+	OpcodeNAND
+	OpcodeLUI
+	OpcodeSW
+	OpcodeLW
+	OpcodeBEQ
+
+	// Extended operations
+	OpcodeWSR
+	OpcodeRSR
+	OpcodeIRET
+)
+
+// The following constants define bits in status register 0.
+const (
+	StatusUserMode = (1 << iota)
+	StatusPaging
+	StatusInterrupts
+	StatusDebugStepping
+	StatusDebugTracing
+)
+
+// The following constants define memory flags.
+const (
+	MemoryExec = (1 << iota)
+	MemoryWrite
+	MemoryRead
+	MemoryAccessed
+	MemoryDirty
+)
+
+// The following constants define interrupt requests.
+const (
+	IrqHALT = iota
+	IrqClock
+	IrqTTY
+	IrqDisk
+	IrqPageFault
+)
+
+// The following constants define memory mapped addresses.
+const (
+	MMClockFrequency = 1<<17 | iota
+	MMTTYStatus
+	MMTTYIn
+	MMTTYOut
+	MMDiskSector
+	MMDiskBuffer
+	MMDiskControl
+	MMClockTicks
+)
+
+const (
+	// MemorySize is the default memory size in 32-bit-wide words.
+	MemorySize = 1 << 20
+
+	// NumRegisters is the number of general purpose registers.
+	NumRegisters = 32
+)
+
+// ClockOneShot is the MMClockFrequency bit selecting one-shot mode.
+const ClockOneShot = 1 << 31
+
+// The following constants define TTY flags in the status register.
+const (
+	TTYIn = 1 << iota
+	TTYOut
+)
+
+// The following constants define the bits of the disk control register.
+const (
+	DiskRead = 1 << iota
+	DiskWrite
+	DiskDone
+	DiskError
+)
@@ -0,0 +1,39 @@
+package vm
+
+import "time"
+
+// Clock is the source of time used by the VM to decide when the
+// clock interrupt should fire. When the Clock field of the VM is nil,
+// the VM uses the system clock, i.e., SystemClock.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock using the system time.
+type SystemClock struct{}
+
+// Now implements Clock.Now.
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+var _ Clock = SystemClock{}
+
+// ManualClock is a Clock whose time only changes when you explicitly
+// call Advance, which is useful to deterministically test programs using
+// the clock interrupt. The zero value is ready to use.
+type ManualClock struct {
+	elapsed time.Duration
+}
+
+// Now implements Clock.Now.
+func (c *ManualClock) Now() time.Time {
+	return time.Unix(0, 0).Add(c.elapsed)
+}
+
+// Advance moves the clock forward by the specified duration.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.elapsed += d
+}
+
+var _ Clock = &ManualClock{}
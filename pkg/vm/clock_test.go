@@ -0,0 +1,166 @@
+package vm
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// irqTracer is an InterruptTracer recording the interrupts.
+type irqTracer struct {
+	irqs []uint32
+}
+
+// BeforeExecute implements Tracer.BeforeExecute.
+func (*irqTracer) BeforeExecute(vm *VM, ci uint32) {}
+
+// AfterExecute implements Tracer.AfterExecute.
+func (*irqTracer) AfterExecute(vm *VM, ci uint32, err error) {}
+
+// BeforeInterrupt implements InterruptTracer.BeforeInterrupt.
+func (tr *irqTracer) BeforeInterrupt(vm *VM, code uint32) {
+	tr.irqs = append(tr.irqs, code)
+}
+
+var _ InterruptTracer = &irqTracer{}
+
+// newClockVM returns a VM using a ManualClock and an irqTracer whose
+// interrupt table is at 1<<10. Interrupts are enabled.
+func newClockVM() (*VM, *ManualClock, *irqTracer) {
+	clock, tracer := &ManualClock{}, &irqTracer{}
+	machine := NewVM(1 << 12)
+	machine.Clock, machine.Tracer = clock, tracer
+	machine.S[0], machine.S[2] = StatusInterrupts, 1<<10
+	return machine, clock, tracer
+}
+
+// iret executes IRET, which returns from the interrupt
+// and services the pending interrupts, if any.
+func iret(t *testing.T, machine *VM) {
+	if err := machine.Execute(OpcodeIRET << 27); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaybeInterruptServicesClockAndTTY(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // Interrupt logs
+	defer log.SetOutput(os.Stderr)
+	machine, clock, tracer := newClockVM()
+	machine.CF = 2
+	if err := machine.MaybeInterrupt(); err != nil { // starts the clock
+		t.Fatal(err)
+	}
+	tty := NewBufferTTY([]byte("ab"))
+	machine.TTY = tty
+	clock.Advance(2 * time.Millisecond)
+	// both the clock and the TTY are pending: the clock has
+	// priority, but the TTY is serviced when the handler returns
+	if err := machine.MaybeInterrupt(); err != nil {
+		t.Fatal(err)
+	}
+	for idx := 0; idx < 3; idx++ {
+		if tracer.irqs[len(tracer.irqs)-1] == IrqTTY {
+			tty.statr &^= TTYIn // the handler consumes the byte
+		}
+		clock.Advance(time.Millisecond)
+		iret(t, machine)
+	}
+	expect := []uint32{IrqClock, IrqTTY, IrqClock, IrqTTY}
+	if !reflect.DeepEqual(tracer.irqs, expect) {
+		t.Fatalf("expected %v, got %v", expect, tracer.irqs)
+	}
+}
+
+func TestManualClockFiresOnce(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // Interrupt logs
+	defer log.SetOutput(os.Stderr)
+	machine, clock, tracer := newClockVM()
+	machine.CF = 10
+	if err := machine.MaybeInterrupt(); err != nil { // starts the clock
+		t.Fatal(err)
+	}
+	clock.Advance(9 * time.Millisecond)
+	if err := machine.MaybeInterrupt(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tracer.irqs) != 0 {
+		t.Fatalf("clock fired too early: %v", tracer.irqs)
+	}
+	clock.Advance(2 * time.Millisecond)
+	for idx := 0; idx < 4; idx++ {
+		if err := machine.MaybeInterrupt(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := []uint32{IrqClock}
+	if !reflect.DeepEqual(tracer.irqs, expect) {
+		t.Fatalf("expected %v, got %v", expect, tracer.irqs)
+	}
+	if machine.PI != 0 || machine.CT != 1 {
+		t.Fatalf("unexpected PI=%#x CT=%d", machine.PI, machine.CT)
+	}
+}
+
+// countClockInterrupts advances the clock by one millisecond at a time
+// for the given number of milliseconds, with interrupts disabled, and
+// returns how many times the clock has raised IrqClock.
+func countClockInterrupts(t *testing.T, machine *VM, clock *ManualClock, millis int) int {
+	var count int
+	machine.S[0] &^= StatusInterrupts
+	for idx := 0; idx <= millis; idx++ {
+		if err := machine.MaybeInterrupt(); err != nil {
+			t.Fatal(err)
+		}
+		if (machine.PI & (1 << IrqClock)) != 0 {
+			machine.PI &^= 1 << IrqClock
+			count++
+		}
+		clock.Advance(time.Millisecond)
+	}
+	return count
+}
+
+func TestClockModes(t *testing.T) {
+	t.Run("periodic", func(t *testing.T) {
+		machine, clock, _ := newClockVM()
+		machine.CF = 10
+		if count := countClockInterrupts(t, machine, clock, 100); count != 10 {
+			t.Fatalf("expected 10 interrupts, got %d", count)
+		}
+		if machine.CF != 10 || machine.CT != 10 {
+			t.Fatalf("unexpected CF=%#x CT=%d", machine.CF, machine.CT)
+		}
+	})
+	t.Run("one-shot", func(t *testing.T) {
+		machine, clock, _ := newClockVM()
+		machine.CF = ClockOneShot | 10
+		if count := countClockInterrupts(t, machine, clock, 100); count != 1 {
+			t.Fatalf("expected 1 interrupt, got %d", count)
+		}
+		if machine.CF != 0 || machine.CT != 1 {
+			t.Fatalf("unexpected CF=%#x CT=%d", machine.CF, machine.CT)
+		}
+		machine.CF = ClockOneShot | 10 // rearm
+		if count := countClockInterrupts(t, machine, clock, 100); count != 1 {
+			t.Fatalf("expected 1 interrupt after rearming, got %d", count)
+		}
+	})
+}
+
+func TestClockTicksRegister(t *testing.T) {
+	machine, clock, _ := newClockVM()
+	machine.CF = 10
+	if count := countClockInterrupts(t, machine, clock, 35); count != 3 {
+		t.Fatalf("expected 3 interrupts, got %d", count)
+	}
+	machine.GPR[1] = MMClockTicks
+	if err := machine.Execute(0x30820000); err != nil { // lw r2 r1 0
+		t.Fatal(err)
+	}
+	if machine.GPR[2] != 3 {
+		t.Fatalf("expected 3 ticks, got %d", machine.GPR[2])
+	}
+}
@@ -0,0 +1,197 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ReadSymbols reads a symbol table from the specified io.Reader. The
+// symbol table contains one symbol per line. Each line contains the
+// symbol address followed by the symbol name. For example:
+//
+//     0x00001000 _main
+//
+// Like in the bytecode format, comments start with `#` and are discarded
+// and so are empty lines. We return a map from address to symbol name. When
+// several symbols share the same address, the last one wins.
+func ReadSymbols(r io.Reader) (map[uint32]string, error) {
+	syms := make(map[uint32]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("vm: invalid symbol table line: '%s'", line)
+		}
+		addr, err := strconv.ParseUint(fields[0], 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		syms[uint32(addr)] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return syms, nil
+}
+
+// DataRange is a range of addresses containing data rather than code.
+type DataRange struct {
+	Addr  uint32 // first address of the range
+	Count uint32 // number of words in the range
+}
+
+// DataRanges is a list of DataRange.
+type DataRanges []DataRange
+
+// Contains returns whether addr is inside any of the ranges.
+func (dr DataRanges) Contains(addr uint32) bool {
+	for _, r := range dr {
+		if addr >= r.Addr && uint64(addr) < uint64(r.Addr)+uint64(r.Count) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadDataRanges reads the ranges of addresses containing data from the
+// specified io.Reader. Each line contains the first address of a range
+// followed by the number of words in the range. For example:
+//
+//     0x00000010 4
+//
+// Comments and empty lines are handled like in ReadSymbols. Use the
+// -datamap flag of cmd/asm to generate this file.
+func ReadDataRanges(r io.Reader) (DataRanges, error) {
+	var dr DataRanges
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("vm: invalid data map line: '%s'", line)
+		}
+		addr, err := strconv.ParseUint(fields[0], 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.ParseUint(fields[1], 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		dr = append(dr, DataRange{Addr: uint32(addr), Count: uint32(count)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return dr, nil
+}
+
+// DisassembleData disassembles a data word, e.g., `.word 0x0000002a`.
+func DisassembleData(ci uint32) string {
+	return fmt.Sprintf(".word 0x%08x", ci)
+}
+
+// StatusRegisterNames contains the name of each status
+// register (see the package documentation).
+var StatusRegisterNames = [NumStatusRegisters]string{
+	"flags",
+	"page_table",
+	"interrupt_table",
+	"interrupt_stack",
+	"fault_address",
+}
+
+// DisassembleAt is like Disassemble except that it also knows the address
+// where the instruction is located. This allows us to compute the absolute
+// target of a BEQ instruction, which we print as `=>0xADDR`. When the syms
+// table is not nil and contains the target address, we print the name of the
+// corresponding symbol instead of the address, e.g., `beq r1 r2 =>done`. We
+// also print the name of the status register used by WSR and RSR, e.g.,
+// `wsr r3 S2=interrupt_table` (see StatusRegisterNames).
+func DisassembleAt(ci, addr uint32, syms map[uint32]string) string {
+	opcode, ra, rb, _, imm17, imm22 := Decode(ci)
+	switch opcode {
+	case OpcodeWSR, OpcodeRSR:
+		if imm22 >= NumStatusRegisters {
+			return Disassemble(ci) // no such register
+		}
+		return fmt.Sprintf("%s r%d S%d=%s", strings.Fields(Disassemble(ci))[0],
+			ra, imm22, StatusRegisterNames[imm22])
+	case OpcodeBEQ:
+		target := addr + 1 + imm17
+		if name, found := syms[target]; found {
+			return fmt.Sprintf("beq r%d r%d =>%s", ra, rb, name)
+		}
+		return fmt.Sprintf("beq r%d r%d =>0x%08x", ra, rb, target)
+	default:
+		return Disassemble(ci)
+	}
+}
+
+// DisassemblePseudo is like DisassembleAt except that it recognizes the
+// encoding of pseudo-instructions and prints the pseudo-instruction rather
+// than the native instruction. The following patterns are recognized:
+//
+// - `add r0 r0 r0` is printed as `nop`;
+//
+// - `nand rA rB rB` is printed as `not rA rB`;
+//
+// - `add rA rB r0` is printed as `mov rA rB`;
+//
+// - `beq r0 r0 N` is printed as `jmp =>target`;
+//
+// - `jalr r0 r0 0` is printed as `halt`;
+//
+// - `jalr r0 r0 N` is printed as `trap N`.
+//
+// When no pattern matches, we fall back to DisassembleAt.
+func DisassemblePseudo(ci, addr uint32, syms map[uint32]string) string {
+	opcode, ra, rb, rc, imm17, _ := Decode(ci)
+	switch {
+	case opcode == OpcodeNAND && rb == rc:
+		return fmt.Sprintf("not r%d r%d", ra, rb)
+	case opcode == OpcodeADD && ra == 0 && rb == 0 && rc == 0:
+		return "nop"
+	case opcode == OpcodeADD && rc == 0:
+		return fmt.Sprintf("mov r%d r%d", ra, rb)
+	case opcode == OpcodeBEQ && ra == 0 && rb == 0:
+		target := addr + 1 + imm17
+		if name, found := syms[target]; found {
+			return fmt.Sprintf("jmp =>%s", name)
+		}
+		return fmt.Sprintf("jmp =>0x%08x", target)
+	case opcode == OpcodeJALR && ra == 0 && rb == 0 && imm17 == 0:
+		return "halt"
+	case opcode == OpcodeJALR && ra == 0 && rb == 0:
+		return fmt.Sprintf("trap %d", imm17)
+	default:
+		return DisassembleAt(ci, addr, syms)
+	}
+}
+
+// DisassembleVerbose is like Disassemble except that it also prints
+// all the fields decoded from the instruction, regardless of whether the
+// instruction uses them, e.g., `addi r1 r0 5 [op=2 ra=1 rb=0 rc=5
+// imm17=5 imm22=5]`. This is useful to understand whether a bug is
+// in the encoder or in the decoder.
+func DisassembleVerbose(ci uint32) string {
+	opcode, ra, rb, rc, imm17, imm22 := Decode(ci)
+	return fmt.Sprintf("%s [op=%d ra=%d rb=%d rc=%d imm17=%d imm22=%d]",
+		Disassemble(ci), opcode, ra, rb, rc, int32(imm17), imm22)
+}
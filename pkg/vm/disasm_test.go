@@ -0,0 +1,116 @@
+package vm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// disasmSyms is the symbol table used by the disassembler tests.
+var disasmSyms = map[uint32]string{
+	1: "loop",
+	4: "done",
+}
+
+func TestDisassembleAt(t *testing.T) {
+	var table = []struct {
+		word   uint32
+		addr   uint32
+		syms   map[uint32]string
+		expect string
+	}{
+		{0x38400001, 2, nil, "beq r1 r0 =>0x00000004"},
+		{0x38400001, 2, disasmSyms, "beq r1 r0 =>done"},
+		{0x3801fffd, 3, disasmSyms, "beq r0 r0 =>loop"},
+		{0x3801fffd, 3, map[uint32]string{}, "beq r0 r0 =>0x00000001"},
+		{0x3800ffff, 0, nil, "beq r0 r0 =>0x00010000"},       // largest positive offset
+		{0x38010000, 0x10000, nil, "beq r0 r0 =>0x00000001"}, // smallest negative offset
+		{0x40c00002, 0, nil, "wsr r3 S2=interrupt_table"},
+		{0x48000004, 0, nil, "rsr r0 S4=fault_address"},
+		{0x48000007, 0, nil, "rsr r0 7"}, // no such register
+		{0x1043ffff, 1, disasmSyms, "addi r1 r1 -1"},
+	}
+	for _, entry := range table {
+		if got := DisassembleAt(entry.word, entry.addr, entry.syms); got != entry.expect {
+			t.Fatalf("0x%08x at 0x%08x: expected %q, got %q",
+				entry.word, entry.addr, entry.expect, got)
+		}
+	}
+}
+
+func TestDisassemblePseudo(t *testing.T) {
+	var table = []struct {
+		word   uint32
+		addr   uint32
+		expect string
+	}{
+		{0x08000000, 0, "nop"},
+		{0x18440002, 0, "not r1 r2"},
+		{0x18440003, 0, "nand r1 r2 r3"},
+		{0x090a0000, 0, "mov r4 r5"},
+		{0x08440003, 0, "add r1 r2 r3"},
+		{0x3801fffd, 3, "jmp =>loop"},
+		{0x38000000, 7, "jmp =>0x00000008"},
+		{0x38400001, 2, "beq r1 r0 =>done"},
+		{0x00000000, 0, "halt"},
+		{0x00000007, 0, "trap 7"},
+		{0x07c20000, 0, "jalr r31 r1 0"},
+		{0x40c00002, 0, "wsr r3 S2=interrupt_table"},
+	}
+	for _, entry := range table {
+		if got := DisassemblePseudo(entry.word, entry.addr, disasmSyms); got != entry.expect {
+			t.Fatalf("0x%08x at 0x%08x: expected %q, got %q",
+				entry.word, entry.addr, entry.expect, got)
+		}
+	}
+}
+
+func TestReadDataRanges(t *testing.T) {
+	dr, err := ReadDataRanges(strings.NewReader(
+		"# data map\n0x00000005 1\n\n0x10 4 # table\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := DataRanges{{Addr: 5, Count: 1}, {Addr: 0x10, Count: 4}}
+	if !reflect.DeepEqual(dr, expect) {
+		t.Fatalf("expected %+v, got %+v", expect, dr)
+	}
+	for addr, inside := range map[uint32]bool{
+		4: false, 5: true, 6: false, 0x0f: false, 0x10: true, 0x13: true, 0x14: false,
+	} {
+		if dr.Contains(addr) != inside {
+			t.Fatalf("0x%08x: expected Contains to return %v", addr, inside)
+		}
+	}
+	if _, err := ReadDataRanges(strings.NewReader("0x10\n")); err == nil {
+		t.Fatal("expected an error for a line without count")
+	}
+	if got := DisassembleData(0x2a); got != ".word 0x0000002a" {
+		t.Fatalf("unexpected data word: %q", got)
+	}
+}
+
+func TestDisassembleRoundTrip(t *testing.T) {
+	var table = []struct {
+		source string
+		expect string
+	}{
+		{"insn: lw r1 r2 -4", "lw r1 r2 -4"},
+		{"insn: lw r1 r2 -65536", "lw r1 r2 -65536"},
+		{"insn: sw r1 r2 -65536", "sw r1 r2 -65536"},
+		{"insn: sw r1 r2 65535", "sw r1 r2 65535"},
+		{"insn: addi r1 r2 65535", "addi r1 r2 65535"},
+		{"insn: addi r1 r2 -1", "addi r1 r2 -1"},
+		{"insn: jalr r1 r2 -65536", "jalr r1 r2 -65536"},
+		// BEQ takes the target address, so we need to be far from it
+		{".space 65535\ninsn: beq r1 r2 0", "beq r1 r2 -65536"},
+		{"insn: beq r1 r2 65536", "beq r1 r2 65535"},
+	}
+	for _, entry := range table {
+		machine, labels := assembleVM(t, 0, entry.source+"\n")
+		ci := machine.M[labels["insn"]]
+		if got := Disassemble(ci); got != entry.expect {
+			t.Fatalf("%q: expected %q, got %q (0x%08x)", entry.source, entry.expect, got, ci)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package vm
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/bassosimone/risc32/pkg/spec"
+)
+
+// The following constants define the bits of the disk control register.
+const (
+	DiskRead  = spec.DiskRead
+	DiskWrite = spec.DiskWrite
+	DiskDone  = spec.DiskDone
+	DiskError = spec.DiskError
+)
+
+const (
+	// DiskSectorSize is the size of a disk sector in bytes.
+	DiskSectorSize = 512
+
+	// DiskSectorWords is the size of a disk sector in 32-bit-wide words.
+	DiskSectorWords = DiskSectorSize / 4
+)
+
+// FileDisk is a disk backed by a file.
+//
+// The user of this struct is supposed to create a new instance by
+// calling OpenFileDisk. The user shall defer calling Close. The user
+// shall otherwise not manipulate the FileDisk and store it inside
+// the Disk field of the VM. The VM shall manage the disk.
+type FileDisk struct {
+	bufr  uint32   // buffer register
+	ctlr  uint32   // control register
+	file  *os.File // backing file
+	sectr uint32   // sector register
+}
+
+// OpenFileDisk opens the file at the given path, creating it if it does
+// not exist, and returns a disk backed by such file.
+func OpenFileDisk(path string) (*FileDisk, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDisk{file: file}, nil
+}
+
+// Close closes the underlying file.
+func (disk *FileDisk) Close() error {
+	return disk.file.Close()
+}
+
+// SectorRegister implements Disk.SectorRegister.
+func (disk *FileDisk) SectorRegister() (*uint32, error) {
+	return &disk.sectr, nil
+}
+
+// BufferRegister implements Disk.BufferRegister.
+func (disk *FileDisk) BufferRegister() (*uint32, error) {
+	return &disk.bufr, nil
+}
+
+// ControlRegister implements Disk.ControlRegister.
+func (disk *FileDisk) ControlRegister() (*uint32, error) {
+	return &disk.ctlr, nil
+}
+
+// InterruptPending implements Disk.InterruptPending. If there is a pending
+// read or write command, this function transfers the sector between the file
+// and memory. The transfer fails, and we set the DiskError bit, when the
+// buffer is not entirely inside of memory. Reading beyond the end of the
+// file is not an error and fills the buffer with zeroes.
+func (disk *FileDisk) InterruptPending(mem []uint32) (bool, error) {
+	if (disk.ctlr & (DiskRead | DiskWrite)) != 0 {
+		disk.ctlr &^= DiskError
+		if err := disk.transfer(mem); err != nil {
+			disk.ctlr |= DiskError
+		}
+		disk.ctlr &^= DiskRead | DiskWrite
+		disk.ctlr |= DiskDone
+	}
+	return (disk.ctlr & DiskDone) != 0, nil
+}
+
+// transfer executes the pending disk command.
+func (disk *FileDisk) transfer(mem []uint32) error {
+	if uint64(disk.bufr)+DiskSectorWords > uint64(len(mem)) {
+		return ErrSIGSEGV
+	}
+	buf := mem[disk.bufr : disk.bufr+DiskSectorWords]
+	off := int64(disk.sectr) * DiskSectorSize
+	var data [DiskSectorSize]byte
+	if (disk.ctlr & DiskWrite) != 0 {
+		for idx, word := range buf {
+			binary.LittleEndian.PutUint32(data[idx*4:], word)
+		}
+		_, err := disk.file.WriteAt(data[:], off)
+		return err
+	}
+	if _, err := disk.file.ReadAt(data[:], off); err != nil && err != io.EOF {
+		return err
+	}
+	for idx := range buf {
+		buf[idx] = binary.LittleEndian.Uint32(data[idx*4:])
+	}
+	return nil
+}
+
+var _ Disk = &FileDisk{}
@@ -0,0 +1,132 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// diskProgram writes the first buffer into sector 3 and then reads the
+// same sector into the second buffer. The .equ allows the test to enable
+// interrupts, in which case the irq3 handler acknowledges the interrupt by
+// clearing the control register and counts the interrupts into r7. The
+// handler must acknowledge first, since the VM records pending interrupts
+// after each instruction, including the ones of the handler.
+const diskProgram = `
+        movi r1 itbl
+        wsr r1 2
+        movi r8 irq3
+        sw r8 r1 IrqDisk
+        movi r8 istack
+        wsr r8 3
+        addi r8 r0 FLAGS
+        wsr r8 0
+        movi r3 MMDiskSector
+        addi r4 r0 3
+        sw r4 r3 0
+        movi r3 MMDiskBuffer
+        movi r4 buf1
+        sw r4 r3 0
+        movi r3 MMDiskControl
+        addi r4 r0 DiskWrite
+        sw r4 r3 0
+        lw r5 r3 0
+        movi r3 MMDiskBuffer
+        movi r4 buf2
+        sw r4 r3 0
+        movi r3 MMDiskControl
+        addi r4 r0 DiskRead
+        sw r4 r3 0
+        lw r6 r3 0
+        wsr r0 0
+        halt
+irq3:   sw r0 r3 0
+        addi r7 r7 1
+        iret
+        .align 10
+itbl:   .space 1024
+buf1:   .space 128
+buf2:   .space 128
+        .align 10
+istack: .fill 0
+`
+
+// newDiskVM returns a VM running diskProgram using a disk backed by
+// a temporary file, along with the labels and the file path.
+func newDiskVM(t *testing.T, flags uint32) (*VM, map[string]uint32, string) {
+	dir, err := ioutil.TempDir("", "risc32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "disk.img")
+	disk, err := OpenFileDisk(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { disk.Close() })
+	source := fmt.Sprintf(".equ FLAGS %d\n%s", flags, diskProgram)
+	machine, labels := assembleVM(t, 1<<12, source)
+	machine.Disk = disk
+	for idx := uint32(0); idx < DiskSectorWords; idx++ {
+		if err := machine.WriteMem(labels["buf1"]+idx, 0xdead0000|idx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return machine, labels, path
+}
+
+// checkDiskTransfer checks that the sector contains the first
+// buffer and that we have read it back into the second buffer.
+func checkDiskTransfer(t *testing.T, machine *VM, labels map[string]uint32, path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4*DiskSectorSize {
+		t.Fatalf("unexpected disk size: %d", len(data))
+	}
+	for idx := uint32(0); idx < DiskSectorWords; idx++ {
+		expect := 0xdead0000 | idx
+		if word := binary.LittleEndian.Uint32(data[3*DiskSectorSize+4*idx:]); word != expect {
+			t.Fatalf("disk word %d: expected %#x, got %#x", idx, expect, word)
+		}
+		if word, _ := machine.ReadMem(labels["buf2"] + idx); word != expect {
+			t.Fatalf("buf2 word %d: expected %#x, got %#x", idx, expect, word)
+		}
+	}
+}
+
+func TestFileDiskPolling(t *testing.T) {
+	machine, labels, path := newDiskVM(t, 0)
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkDiskTransfer(t, machine, labels, path)
+	if machine.GPR[5] != DiskDone || machine.GPR[6] != DiskDone {
+		t.Fatalf("unexpected control register: r5=%#x r6=%#x", machine.GPR[5], machine.GPR[6])
+	}
+	if machine.GPR[7] != 0 {
+		t.Fatalf("unexpected interrupts with interrupts disabled: %d", machine.GPR[7])
+	}
+}
+
+func TestFileDiskInterrupt(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // Interrupt logs
+	defer log.SetOutput(os.Stderr)
+	machine, labels, path := newDiskVM(t, StatusInterrupts)
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkDiskTransfer(t, machine, labels, path)
+	if machine.GPR[7] != 2 {
+		t.Fatalf("expected two IrqDisk interrupts, got %d", machine.GPR[7])
+	}
+	if machine.GPR[5] != 0 || machine.GPR[6] != 0 {
+		t.Fatalf("the handler did not acknowledge: r5=%#x r6=%#x", machine.GPR[5], machine.GPR[6])
+	}
+}
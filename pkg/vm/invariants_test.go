@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// invariantsSeeds is the seed corpus of the fuzz test.
+var invariantsSeeds = []uint32{
+	0x00000000, // halt
+	0x08000000, // nop
+	0x08020001, // add r0 r1 r1
+	0x10000005, // addi r0 r0 5
+	0x20000001, // lui r0 1
+	0x30000000, // lw r0 r0 0
+	0x40400000, // wsr r1 0
+	0x40400001, // wsr r1 1
+	0x40400004, // wsr r1 4
+	0x48000000, // rsr r0 0
+	0x48000003, // rsr r0 3
+	0x50000000, // iret
+	0x58000000, // opcode 11
+	0x00000007, // trap 7
+	0x3801ffff, // beq r0 r0 -1
+	0xf8000000, // opcode 31
+	PoisonWord,
+}
+
+// checkInvariants executes ci on machine and fails unless the VM is still
+// in a consistent state. Because a program may legitimately jump outside
+// of the address space, we ignore the PC invariant after a jump.
+func checkInvariants(t *testing.T, machine *VM, ci uint32) {
+	machine.PC++ // like Fetch would do
+	execErr := machine.Execute(ci)
+	if err := machine.CheckInvariants(); err != nil {
+		switch DecodeOpcode(ci) {
+		case OpcodeBEQ, OpcodeJALR, OpcodeIRET:
+			machine.PC = 0 // allow to continue with the next word
+			if machine.CheckInvariants() == nil {
+				return
+			}
+		}
+		t.Fatalf("0x%08x (%s): %s (execute: %v)", ci, Disassemble(ci), err, execErr)
+	}
+	if errors.Is(execErr, ErrInvariant) {
+		t.Fatalf("0x%08x: unexpected error: %s", ci, execErr)
+	}
+}
+
+// newFuzzVM creates a VM with random registers for fuzzing.
+func newFuzzVM(rnd *rand.Rand) *VM {
+	machine := NewVM(1 << 12)
+	machine.Clock = &ManualClock{}
+	for idx := 1; idx < NumRegisters; idx++ {
+		machine.GPR[idx] = rnd.Uint32()
+	}
+	machine.GPR[1] = 0xffff_ffff // all reserved bits of S[0]
+	return machine
+}
+
+func TestCheckInvariantsSeeds(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // Interrupt logs
+	defer log.SetOutput(os.Stderr)
+	for _, ci := range invariantsSeeds {
+		for _, lenient := range []bool{false, true} {
+			machine := newFuzzVM(rand.New(rand.NewSource(1)))
+			machine.LenientOpcodes = lenient
+			checkInvariants(t, machine, ci)
+		}
+	}
+}
+
+func TestCheckInvariantsRandomWords(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // Interrupt logs
+	defer log.SetOutput(os.Stderr)
+	const seeds, words = 64, 512
+	for seed := int64(0); seed < seeds; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		machine := newFuzzVM(rnd)
+		for idx := 0; idx < words; idx++ {
+			ci := rnd.Uint32()
+			if idx%2 == 0 {
+				// mutate a seed, so that we also exercise
+				// the interesting parts of the opcode space
+				ci = invariantsSeeds[rnd.Intn(len(invariantsSeeds))] ^ (1 << rnd.Intn(27))
+			}
+			checkInvariants(t, machine, ci)
+		}
+	}
+}
+
+func TestCheckInvariantsPC(t *testing.T) {
+	machine := NewVM(1 << 12)
+	machine.PC = 0x10000
+	if err := machine.CheckInvariants(); !errors.Is(err, ErrInvariant) {
+		t.Fatalf("expected ErrInvariant, got %v", err)
+	}
+	// With paging, the PC is a virtual address, which may
+	// well be larger than the size of the physical memory.
+	machine.S[0] = StatusPaging
+	if err := machine.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	machine.PC = NumPageTableEntries << 10
+	if err := machine.CheckInvariants(); !errors.Is(err, ErrInvariant) {
+		t.Fatalf("expected ErrInvariant, got %v", err)
+	}
+}
@@ -1,18 +1,24 @@
 package vm
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
-	"strings"
+	"sync"
 	"time"
+
+	"github.com/bassosimone/risc32/pkg/spec"
 )
 
 // The following constants define TTY flags in the status register.
 const (
-	TTYIn = 1 << iota
-	TTYOut
+	TTYIn  = spec.TTYIn
+	TTYOut = spec.TTYOut
 )
 
 // The following errors may be emitted by the TTY implementation.
@@ -26,31 +32,112 @@ var (
 // calling TTYAcceptConn. The user shall defer calling Close. The user
 // shall otherwise not manipulate the SerialTTY and store it inside
 // the TTY field of the VM. The VM shall manage the TTY.
+//
+// The SerialTTY uses background goroutines for reading from and writing
+// to the connection, so that polling for interrupts does not cause any
+// system call and never blocks the VM.
 type SerialTTY struct {
-	conn  net.Conn // control conn
-	inr   uint32   // input register
-	outr  uint32   // output register
-	statr uint32   // status register
+	conn   net.Conn         // control conn
+	inr    uint32           // input register
+	once   sync.Once        // makes Close idempotent
+	output chan byte        // outgoing bytes
+	outr   uint32           // output register
+	reader *ttyReader       // background reader
+	statr  uint32           // status register
+	wdone  chan interface{} // closed when writeLoop terminates
+	werr   chan error       // write error (if any)
+	wfail  error            // write error we have already received
 }
 
-// TTYAcceptConn waits for a controlling TCP connection to attach
-// to the console. Once there is a control connection, this function
-// returns with the serial TTY console instance.
-func TTYAcceptConn() (*SerialTTY, error) {
-	nl, err := net.Listen("tcp", "127.0.0.1:0")
+// TTYAcceptConn listens on the TCP address (e.g., "127.0.0.1:0") and waits
+// for a controlling connection to attach to the console. Once there is a
+// control connection, this function returns with the serial TTY console
+// instance, whose LocalAddr method returns the address where we listened,
+// which is useful when address uses port zero. When ctx is done before a
+// connection attaches, this function returns the error of the context.
+func TTYAcceptConn(ctx context.Context, address string) (*SerialTTY, error) {
+	nl, err := net.Listen("tcp", address)
 	if err != nil {
 		return nil, err
 	}
+	defer nl.Close() // we only accept a single connection
 	log.Printf("tty: waiting for console to attach on %s/tcp...", nl.Addr())
+	done := make(chan interface{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			nl.Close() // unblocks Accept
+		case <-done:
+		}
+	}()
 	conn, err := nl.Accept()
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
-	return &SerialTTY{conn: conn}, nil
+	return newSerialTTY(conn), nil
+}
+
+// newSerialTTY creates a SerialTTY using conn and starts the
+// background goroutines reading from and writing to conn.
+func newSerialTTY(conn net.Conn) *SerialTTY {
+	tty := &SerialTTY{
+		conn:   conn,
+		output: make(chan byte, 4096),
+		reader: newTTYReader(conn),
+		wdone:  make(chan interface{}),
+		werr:   make(chan error, 1),
+	}
+	go tty.writeLoop()
+	return tty
+}
+
+// writeLoop writes the outgoing bytes to the connection. When it cannot
+// write anymore, it posts the error on werr and discards the remaining
+// outgoing bytes, so that sending them never blocks. It closes wdone when
+// the output channel has been closed and drained.
+func (tty *SerialTTY) writeLoop() {
+	defer close(tty.wdone)
+	var failed bool
+	for c := range tty.output {
+		if failed {
+			continue
+		}
+		if _, err := tty.conn.Write([]byte{c}); err != nil {
+			tty.werr <- err
+			failed = true
+		}
+	}
+}
+
+// serialTTYCloseTimeout is the maximum time Close waits
+// for delivering the pending outgoing bytes.
+const serialTTYCloseTimeout = 5 * time.Second
+
+// Close delivers the pending outgoing bytes, including the byte in the
+// output register when TTYOut is set, and then closes the connection. This
+// ensures that a program halting just after writing into the TTY does not
+// lose its last bytes. We give up delivering after serialTTYCloseTimeout.
+// Calling Close more than once is safe and the later calls return nil.
+func (tty *SerialTTY) Close() (err error) {
+	tty.once.Do(func() {
+		err = tty.close()
+	})
+	return
 }
 
-// Close closes the underlying connection.
-func (tty *SerialTTY) Close() error {
+// close implements Close.
+func (tty *SerialTTY) close() error {
+	tty.conn.SetWriteDeadline(time.Now().Add(serialTTYCloseTimeout))
+	if (tty.statr & TTYOut) != 0 {
+		tty.output <- byte(tty.outr & 0xff)
+		tty.statr &^= TTYOut // byte has been queued
+	}
+	close(tty.output)
+	<-tty.wdone
 	return tty.conn.Close()
 }
 
@@ -74,40 +161,220 @@ func (tty *SerialTTY) StatusRegister() (*uint32, error) {
 	return &tty.statr, nil
 }
 
-// InterruptPending implements TTY.InterruptPending. This function may
-// block for a bunch of milliseconds if there is no input from the conn
-// but will not wait forever and will not block the VM forever.
+// InterruptPending implements TTY.InterruptPending. This function never
+// blocks, because the actual I/O happens in background goroutines.
 func (tty *SerialTTY) InterruptPending() (bool, error) {
-	// The timeout is such that we certainly can read/write if we have data
-	// however, if we don't have data, we don't block the VM.
-	tty.conn.SetDeadline(time.Now().Add(time.Millisecond))
+	if tty.wfail == nil {
+		select {
+		case tty.wfail = <-tty.werr:
+		default:
+			// no write error
+		}
+	}
+	if tty.wfail != nil {
+		return false, fmt.Errorf("%w: %s", ErrTTYDetach, tty.wfail.Error())
+	}
 	if (tty.statr & TTYOut) != 0 {
-		var c [1]byte
-		c[0] = byte(tty.outr & 0xff)
-		if _, err := tty.conn.Write(c[:]); err != nil {
-			// We're basically polling the connection every time and we don't
-			// declare an interrupt when we can't do I/O.
-			if strings.HasSuffix(err.Error(), "i/o timeout") {
-				return false, nil
-			}
+		select {
+		case tty.output <- byte(tty.outr & 0xff):
+			tty.statr &^= TTYOut // byte has been queued
+		default:
+			// We don't declare an interrupt when we can't do I/O
+			// because the output queue is full.
+			return false, nil
+		}
+	}
+	if (tty.statr & TTYIn) == 0 {
+		c, ok, err := tty.reader.poll()
+		if err != nil {
 			return false, fmt.Errorf("%w: %s", ErrTTYDetach, err.Error())
 		}
+		if ok {
+			tty.statr |= TTYIn // byte has been received
+			tty.inr = uint32(c)
+		}
+	}
+	return (tty.statr & (TTYIn | TTYOut)) != 0, nil
+}
+
+var _ TTY = &SerialTTY{}
+
+// ttyReader reads bytes in a background goroutine and allows
+// a TTY to poll for them without blocking.
+type ttyReader struct {
+	err   error     // read error (valid when input is closed)
+	input chan byte // incoming bytes
+}
+
+// newTTYReader creates a new ttyReader reading from r and
+// starts the background goroutine reading from r.
+func newTTYReader(r io.Reader) *ttyReader {
+	tr := &ttyReader{input: make(chan byte, 4096)}
+	go tr.readLoop(r)
+	return tr
+}
+
+// readLoop reads from r and posts the incoming bytes on the input
+// channel. It closes the channel when it cannot read anymore.
+func (tr *ttyReader) readLoop(r io.Reader) {
+	defer close(tr.input)
+	var c [1]byte
+	for {
+		if _, err := r.Read(c[:]); err != nil {
+			tr.err = err // safe: published by closing the channel
+			return
+		}
+		tr.input <- c[0]
+	}
+}
+
+// poll returns the next incoming byte, if any, without blocking. The
+// returned error is not nil when we cannot read anymore.
+func (tr *ttyReader) poll() (byte, bool, error) {
+	select {
+	case c, ok := <-tr.input:
+		if !ok {
+			return 0, false, tr.err
+		}
+		return c, true, nil
+	default:
+		return 0, false, nil
+	}
+}
+
+// StdioTTY is a TTY using an io.Reader for input and an io.Writer
+// for output, typically the standard input and output.
+//
+// The user of this struct is supposed to create a new instance by
+// calling NewStdioTTY. The user shall defer calling Close to flush
+// the buffered output. The user shall otherwise not manipulate the
+// StdioTTY and store it inside the TTY field of the VM.
+type StdioTTY struct {
+	inr    uint32        // input register
+	outr   uint32        // output register
+	reader *ttyReader    // background reader
+	statr  uint32        // status register
+	w      *bufio.Writer // buffered output
+}
+
+// NewStdioTTY creates a new StdioTTY reading from r and writing to w. The
+// output is line buffered. This function starts a background goroutine
+// reading from r, so that the VM never blocks waiting for input.
+func NewStdioTTY(r io.Reader, w io.Writer) *StdioTTY {
+	return &StdioTTY{reader: newTTYReader(r), w: bufio.NewWriter(w)}
+}
+
+// Close flushes the buffered output, including the byte in the
+// output register when TTYOut is set.
+func (tty *StdioTTY) Close() error {
+	if (tty.statr & TTYOut) != 0 {
+		if err := tty.w.WriteByte(byte(tty.outr & 0xff)); err != nil {
+			return err
+		}
 		tty.statr &^= TTYOut // byte has been sent
 	}
-	if (tty.statr & TTYIn) == 0 {
-		var c [1]byte
-		if _, err := tty.conn.Read(c[:]); err != nil {
-			// We're basically polling the connection every time and we don't
-			// declare an interrupt when we can't do I/O.
-			if strings.HasSuffix(err.Error(), "i/o timeout") {
-				return false, nil
+	return tty.w.Flush()
+}
+
+// InRegister implements TTY.InRegister.
+func (tty *StdioTTY) InRegister() (*uint32, error) {
+	return &tty.inr, nil
+}
+
+// OutRegister implements TTY.OutRegister.
+func (tty *StdioTTY) OutRegister() (*uint32, error) {
+	return &tty.outr, nil
+}
+
+// StatusRegister implements TTY.StatusRegister.
+func (tty *StdioTTY) StatusRegister() (*uint32, error) {
+	return &tty.statr, nil
+}
+
+// InterruptPending implements TTY.InterruptPending. This function never
+// blocks. When the input reaches EOF (or any other error occurs), this
+// function returns an error wrapping ErrTTYDetach.
+func (tty *StdioTTY) InterruptPending() (bool, error) {
+	if (tty.statr & TTYOut) != 0 {
+		c := byte(tty.outr & 0xff)
+		if err := tty.w.WriteByte(c); err != nil {
+			return false, fmt.Errorf("%w: %s", ErrTTYDetach, err.Error())
+		}
+		if c == '\n' {
+			if err := tty.w.Flush(); err != nil {
+				return false, fmt.Errorf("%w: %s", ErrTTYDetach, err.Error())
 			}
+		}
+		tty.statr &^= TTYOut // byte has been sent
+	}
+	if (tty.statr & TTYIn) == 0 {
+		c, ok, err := tty.reader.poll()
+		if err != nil {
 			return false, fmt.Errorf("%w: %s", ErrTTYDetach, err.Error())
 		}
+		if ok {
+			tty.statr |= TTYIn // byte has been received
+			tty.inr = uint32(c)
+		}
+	}
+	return (tty.statr & (TTYIn | TTYOut)) != 0, nil
+}
+
+var _ TTY = &StdioTTY{}
+
+// BufferTTY is a TTY whose input is a byte slice and whose output is
+// collected into a buffer, which makes it suitable for testing programs
+// using the TTY in a deterministic way. Once we have consumed all the
+// input, we don't raise TTYIn interrupts anymore.
+//
+// The user of this struct is supposed to create a new instance by
+// calling NewBufferTTY and to store it inside the TTY field of the VM.
+// After running the VM, Output returns what the program has written.
+type BufferTTY struct {
+	input  []byte       // input not consumed yet
+	inr    uint32       // input register
+	outr   uint32       // output register
+	output bytes.Buffer // collected output
+	statr  uint32       // status register
+}
+
+// NewBufferTTY creates a new BufferTTY reading from input.
+func NewBufferTTY(input []byte) *BufferTTY {
+	return &BufferTTY{input: input}
+}
+
+// Output returns the bytes written by the program so far.
+func (tty *BufferTTY) Output() []byte {
+	return tty.output.Bytes()
+}
+
+// InRegister implements TTY.InRegister.
+func (tty *BufferTTY) InRegister() (*uint32, error) {
+	return &tty.inr, nil
+}
+
+// OutRegister implements TTY.OutRegister.
+func (tty *BufferTTY) OutRegister() (*uint32, error) {
+	return &tty.outr, nil
+}
+
+// StatusRegister implements TTY.StatusRegister.
+func (tty *BufferTTY) StatusRegister() (*uint32, error) {
+	return &tty.statr, nil
+}
+
+// InterruptPending implements TTY.InterruptPending.
+func (tty *BufferTTY) InterruptPending() (bool, error) {
+	if (tty.statr & TTYOut) != 0 {
+		tty.output.WriteByte(byte(tty.outr & 0xff))
+		tty.statr &^= TTYOut // byte has been sent
+	}
+	if (tty.statr&TTYIn) == 0 && len(tty.input) > 0 {
 		tty.statr |= TTYIn // byte has been received
-		tty.inr = uint32(c[0])
+		tty.inr = uint32(tty.input[0])
+		tty.input = tty.input[1:]
 	}
 	return (tty.statr & (TTYIn | TTYOut)) != 0, nil
 }
 
-var _ TTY = &SerialTTY{}
+var _ TTY = &BufferTTY{}
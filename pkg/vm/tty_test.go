@@ -0,0 +1,214 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSerialTTYCloseFlushesTheLastByte(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	tty := newSerialTTY(server)
+	received := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(client)
+		received <- data
+	}()
+	tty.outr, tty.statr = '!', TTYOut // the program has just written '!'
+	if err := tty.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-received; string(data) != "!" {
+		t.Fatalf("expected %q, got %q", "!", data)
+	}
+	if err := tty.Close(); err != nil {
+		t.Fatalf("the second Close failed: %s", err)
+	}
+}
+
+// pollTTY calls tty.InterruptPending until cond returns true.
+func pollTTY(t *testing.T, tty TTY, cond func() bool) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out polling the TTY")
+		}
+		if _, err := tty.InterruptPending(); err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+func TestSerialTTYBothWays(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	tty := newSerialTTY(server)
+	defer tty.Close()
+	go client.Write([]byte("hi"))
+	var input []byte
+	err := pollTTY(t, tty, func() bool {
+		if (tty.statr & TTYIn) != 0 {
+			input = append(input, byte(tty.inr))
+			tty.statr &^= TTYIn // like the kernel would do
+		}
+		return len(input) >= 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(input) != "hi" {
+		t.Fatalf("expected %q, got %q", "hi", input)
+	}
+	received := make(chan byte)
+	go func() {
+		var c [1]byte
+		client.Read(c[:])
+		received <- c[0]
+	}()
+	tty.outr, tty.statr = 'x', TTYOut
+	if err := pollTTY(t, tty, func() bool { return (tty.statr & TTYOut) == 0 }); err != nil {
+		t.Fatal(err)
+	}
+	if c := <-received; c != 'x' {
+		t.Fatalf("expected 'x', got %q", c)
+	}
+}
+
+// failingWriteConn is a net.Conn whose Write always fails.
+type failingWriteConn struct {
+	net.Conn
+}
+
+// Write implements net.Conn.Write.
+func (failingWriteConn) Write(b []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestSerialTTYWriteErrorDetaches(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	tty := newSerialTTY(failingWriteConn{server})
+	defer tty.Close()
+	tty.outr, tty.statr = 'x', TTYOut
+	err := pollTTY(t, tty, func() bool { return false })
+	if !errors.Is(err, ErrTTYDetach) || !strings.Contains(err.Error(), "broken pipe") {
+		t.Fatalf("expected ErrTTYDetach, got %v", err)
+	}
+}
+
+// BenchmarkSerialTTYInterruptPending measures polling an idle TTY, which
+// should take nanoseconds, since polling does not perform any I/O.
+func BenchmarkSerialTTYInterruptPending(b *testing.B) {
+	client, server := net.Pipe()
+	defer client.Close()
+	tty := newSerialTTY(server)
+	defer tty.Close()
+	b.ReportAllocs()
+	for idx := 0; idx < b.N; idx++ {
+		if _, err := tty.InterruptPending(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStdioTTY(t *testing.T) {
+	pr, pw := io.Pipe()
+	var out bytes.Buffer
+	tty := NewStdioTTY(pr, &out)
+	go pw.Write([]byte("ab"))
+	var input []byte
+	err := pollTTY(t, tty, func() bool {
+		if (tty.statr & TTYIn) != 0 {
+			input = append(input, byte(tty.inr))
+			tty.statr &^= TTYIn // like the kernel would do
+		}
+		return len(input) >= 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(input) != "ab" {
+		t.Fatalf("expected %q, got %q", "ab", input)
+	}
+	for _, c := range []byte("x\ny") {
+		tty.outr, tty.statr = uint32(c), TTYOut
+		if _, err := tty.InterruptPending(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out.String() != "x\n" {
+		t.Fatalf("the output is not line buffered: %q", out.String())
+	}
+	pw.Close() // EOF
+	err = pollTTY(t, tty, func() bool { return false })
+	if !errors.Is(err, ErrTTYDetach) || !strings.Contains(err.Error(), "EOF") {
+		t.Fatalf("expected ErrTTYDetach, got %v", err)
+	}
+	tty.outr, tty.statr = 'z', TTYOut
+	if err := tty.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "x\nyz" {
+		t.Fatalf("Close did not flush the output: %q", out.String())
+	}
+}
+
+// echoKernel echoes the TTY input until it reads a dot. The IrqTTY
+// handler ignores the interrupt unless TTYIn is set and otherwise
+// acknowledges the input byte while asking the TTY to send it. The
+// handler halts after echoing the dot, since interrupts are disabled.
+const echoKernel = `
+        movi r1 itbl
+        wsr r1 2
+        movi r8 irq2
+        sw r8 r1 IrqTTY
+        movi r8 istack
+        wsr r8 3
+        movi r1 MMTTYStatus
+        movi r2 MMTTYIn
+        movi r3 MMTTYOut
+        addi r8 r0 StatusInterrupts
+        wsr r8 0
+wait:   jmp wait
+irq2:   lw r4 r1 0
+        addi r5 r0 TTYIn
+        bne r4 r5 ret
+        lw r6 r2 0
+        sw r6 r3 0
+        addi r5 r0 TTYOut
+        sw r5 r1 0
+        addi r7 r0 46
+        beq r6 r7 done
+ret:    iret
+done:   halt
+        .align 10
+itbl:   .space 1024
+istack: .fill 0
+`
+
+func TestBufferTTYEchoKernel(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // Interrupt logs
+	defer log.SetOutput(os.Stderr)
+	machine, _ := assembleVM(t, 1<<12, echoKernel)
+	tty := NewBufferTTY([]byte("hello, world.ignored"))
+	machine.TTY = tty
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := machine.RunContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if output := string(tty.Output()); output != "hello, world." {
+		t.Fatalf("unexpected output: %q", output)
+	}
+}
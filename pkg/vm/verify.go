@@ -0,0 +1,82 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidInstruction indicates that Verify found a word
+// that is not a valid instruction.
+var ErrInvalidInstruction = errors.New("vm: invalid instruction")
+
+// VerifyError is the error returned by Verify. It wraps
+// ErrInvalidInstruction and describes the offending word.
+type VerifyError struct {
+	Addr   uint32 // address of the offending word
+	Reason string // why the word is not a valid instruction
+	Word   uint32 // offending word
+}
+
+// Error implements error.Error.
+func (err *VerifyError) Error() string {
+	return fmt.Sprintf("%s: %s at 0x%08x (0x%08x)",
+		ErrInvalidInstruction.Error(), err.Reason, err.Addr, err.Word)
+}
+
+// Unwrap allows to unwrap the underlying error.
+func (err *VerifyError) Unwrap() error {
+	return ErrInvalidInstruction
+}
+
+// Verify checks whether each word of code, which we assume to be loaded
+// starting from address zero, is a valid instruction and returns a
+// VerifyError describing the first invalid word, if any. Because data
+// words are not instructions, you should rather use VerifyWithData when
+// the code also contains data (e.g., `.fill` or `.space`).
+func Verify(code []uint32) error {
+	return VerifyWithData(code, nil)
+}
+
+// VerifyWithData is like Verify but skips the words within data. A word
+// is a valid instruction when its opcode is known and the fields that the
+// instruction does not use are zero. Because fields are five bits wide, all
+// register indices are valid. We also reject WSR and RSR referring to status
+// registers that do not exist, which always fault when executed. Note that
+// we do not check the rest of the semantics (e.g., jump targets).
+func VerifyWithData(code []uint32, data DataRanges) error {
+	for addr, ci := range code {
+		if data.Contains(uint32(addr)) {
+			continue
+		}
+		if reason := verifyInstruction(ci); reason != "" {
+			return &VerifyError{Addr: uint32(addr), Reason: reason, Word: ci}
+		}
+	}
+	return nil
+}
+
+// verifyInstruction returns why ci is not a valid instruction
+// or an empty string when ci is a valid instruction.
+func verifyInstruction(ci uint32) string {
+	opcode, _, _, _, _, imm22 := Decode(ci)
+	switch opcode {
+	case OpcodeADD, OpcodeNAND:
+		// <Opcode: 5><RA: 5><RB: 5><Unused: 12><RC: 5>
+		if (ci & 0b1_1111_1111_1110_0000) != 0 {
+			return "nonzero unused bits"
+		}
+	case OpcodeADDI, OpcodeLUI, OpcodeSW, OpcodeLW, OpcodeBEQ, OpcodeJALR:
+		// all the bits are meaningful
+	case OpcodeWSR, OpcodeRSR:
+		if imm22 >= NumStatusRegisters {
+			return fmt.Sprintf("no such status register: %d", imm22)
+		}
+	case OpcodeIRET:
+		if DecodeImm22(ci) != 0 || DecodeRA(ci) != 0 {
+			return "nonzero unused bits"
+		}
+	default:
+		return fmt.Sprintf("unknown opcode: %d", opcode)
+	}
+	return ""
+}
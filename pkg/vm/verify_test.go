@@ -0,0 +1,60 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+// cleanCode is valid bytecode computing 5+6 into r3.
+var cleanCode = []uint32{
+	0x10400005, // addi r1 r0 5
+	0x10800006, // addi r2 r0 6
+	0x08c20002, // add r3 r1 r2
+	0x40400000, // wsr r1 0
+	0x48800004, // rsr r2 4
+	0x50000000, // iret
+	0x00000000, // halt
+}
+
+func TestVerifyCleanCode(t *testing.T) {
+	if err := Verify(cleanCode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyInvalidInstructions(t *testing.T) {
+	var table = []struct {
+		word   uint32
+		reason string
+	}{
+		{0x58000000, "unknown opcode: 11"},
+		{PoisonWord, "unknown opcode: 31"},
+		{0x08c20102, "nonzero unused bits"}, // add with bits between rB and rC
+		{0x50000001, "nonzero unused bits"}, // iret with an immediate
+		{0x48800005, "no such status register: 5"},
+	}
+	for _, entry := range table {
+		code := append(append([]uint32{}, cleanCode[:2]...), entry.word)
+		var verr *VerifyError
+		if err := Verify(code); !errors.As(err, &verr) {
+			t.Fatalf("0x%08x: expected a VerifyError, got %v", entry.word, err)
+		}
+		if !errors.Is(verr, ErrInvalidInstruction) {
+			t.Fatalf("0x%08x: the error does not wrap ErrInvalidInstruction", entry.word)
+		}
+		if verr.Addr != 2 || verr.Word != entry.word || verr.Reason != entry.reason {
+			t.Fatalf("0x%08x: unexpected error: %+v", entry.word, verr)
+		}
+	}
+}
+
+func TestVerifyWithDataSkipsData(t *testing.T) {
+	code := append(append([]uint32{}, cleanCode...), PoisonWord, 0x58000000)
+	data := DataRanges{{Addr: uint32(len(cleanCode)), Count: 2}}
+	if err := VerifyWithData(code, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(code); !errors.Is(err, ErrInvalidInstruction) {
+		t.Fatalf("expected ErrInvalidInstruction, got %v", err)
+	}
+}
@@ -32,7 +32,18 @@
 //
 // The comment, if any, will be discarded. The format of the output number
 // MUST be hexadecimal with a leading 0x prefix. It does not necessarily need
-// to have a bunch of leading zeroes, but that would be nice.
+// to have a bunch of leading zeroes, but that would be nice. Empty lines and
+// lines only containing a comment are ignored, except for the line
+// specifying the entry point of the program, i.e., the address of the
+// first instruction to execute, which defaults to zero:
+//
+//     # entry: 0x00001000
+//
+// Likewise, the bytecode may end with a line containing the checksum of
+// all the words, which the loader verifies when present (see
+// Checksum). Older loaders just ignore it as a comment:
+//
+//     # checksum: 0x1c291ca3
 //
 // Instruction set
 //
@@ -53,7 +64,7 @@
 // The status register with index 0 contains the processor flags. It currently
 // defines the following bit flags:
 //
-//     <Unused: 29><Flags: 3>
+//     <Reserved: 27><Flags: 5>
 //
 // The following flags are defined:
 //
@@ -63,20 +74,39 @@
 // - DebugStepping (1<<3): turns on stepping
 // - DebugTracing (1<<4): turns on tracing
 //
+// Using WSR to set any reserved bit causes a fault, because such bits may
+// acquire a meaning in the future and setting them is most likely a bug.
+//
+// Changes to status register 0 take effect from the next instruction. For
+// example, when WSR sets UserMode and Paging, the PC becomes a virtual address
+// and the next fetch goes through the page table, faulting unless the page is
+// executable. We never cache permissions: each memory access uses the current
+// value of status register 0 and of the page table. Because of this, the
+// kernel should rather enter user mode using IRET, which atomically restores
+// status register 0, the stack pointer, and the program counter.
+//
 // The status register with index 1 contains the address in memory of the
 // page table. The page table contains 1,024 32-bit entries. We use the page
 // table only when the Paging flag is set. The page table must be aligned
 // to a 1<<10 boundary, otherwise the machine halts.
 //
 // The status register with index 2 contains the address in memory of the
-// interrupt handlers vector. This table contains 16 32-bit entries. We only
-// use this table when the Interrupts flag is set. Also the interrupt table
-// must be aligned to a 1<<10 boundary, otherwise the machine halts.
+// interrupt handlers vector. This table contains NumInterrupts (by default
+// 16) 32-bit entries (see "Interrupts" below). We only use this table when
+// the Interrupts flag is set. Also the interrupt table must be aligned to a
+// 1<<10 boundary, otherwise the machine halts. The whole table must fit into
+// the physical memory, otherwise interrupting faults.
 //
 // The status register with index 3 contains the address in memory of the
 // stack that should be used by interrupts. This value must be 1<<10 aligned
 // like the page table and the interrupt handlers vector.
 //
+// The status register with index 4 contains the virtual address that caused
+// the last page fault (see below). The kernel may also write into it.
+//
+// Attempting to write a value that is not 1<<10 aligned into the status
+// registers with index 1, 2, and 3 causes a fault.
+//
 // Attempting to access a non-existent status register causes a fault.
 //
 // Page table
@@ -90,7 +120,9 @@
 //     <PageID: 22><Address: 10>
 //
 // Status register 1 contains the address the page table. By adding the PageID
-// offset to such address, we fetch the corresponding entry.
+// offset to such address, we fetch the corresponding entry. Because the page
+// table contains 1,024 entries, only PageIDs lower than 1,024 are valid, and
+// accessing a virtual address with a larger PageID causes a fault.
 //
 // The entry itself is as follows:
 //
@@ -103,17 +135,32 @@
 // - `W` (1<<1): true if the page is writeable
 // - `R` (1<<2): true if the page is readable
 //
+// Additionally, the hardware uses the following flags to record how the
+// page has been used, and the kernel may clear them by writing into the
+// page table (e.g., to decide which pages to swap out):
+//
+// - `A` (1<<3): set by the hardware when the page is accessed
+// - `D` (1<<4): set by the hardware when the page is written
+//
 // When the code accesses a user page without the proper restrictions, the
 // processor will emit a fault and possibly terminate.
 //
 // A zeroed entry in the page table always causes a fault.
 //
+// When a memory access faults and interrupts are enabled, the hardware
+// stores the faulting virtual address into status register 4 and raises an
+// IrqPageFault interrupt. The saved program counter is the address of the
+// faulting instruction, so that IRET executes it again once the kernel has
+// fixed the page table. When interrupts are disabled, the VM stops.
+//
 // Interrupts
 //
-// We have 32-bit 16 handlers. Each handler is the address of the handler
-// routine to jump to. The hardware saves the status register, the next
-// program counter, and the stack pointer. Then, it clears UserMode, Interrupts,
-// and Paging, and transfers the control to the specified routine.
+// By default, we have NumInterrupts (i.e., 16) 32-bit handlers, but the
+// number of handlers is configurable using the NI field of the VM. Each
+// handler is the address of the handler routine to jump to. The hardware
+// saves the status register, the next program counter, and the stack pointer.
+// Then, it clears UserMode, Interrupts, and Paging, and transfers the control
+// to the specified routine.
 //
 // Because the interrupt service routine runs with interrupts disabled, you
 // are not supposed to receive more interrupts until done. Because it runs with
@@ -122,20 +169,39 @@
 // you must jump to the service routine even if paging is such that you'd not
 // otherwise be able to jump to the routine address.
 //
+// The interrupt service routine may, however, enable interrupts again, e.g.,
+// to let the clock interrupt a long running routine. In such case, the hardware
+// pushes the saved state of the interrupted routine onto a hardware managed
+// stack, which IRET pops, so that each IRET returns to the context it
+// interrupted. A nested interrupt does not swap to the interrupt stack, since
+// the routine is already using it. We support up to MaxInterruptNesting
+// nested interrupts, after which interrupting fails.
+//
 // The interrupt ID is indicated by the immediate and it is used to choose
-// the proper handler in the table indicated by status register 2. We handle
-// 16 interrupts. Any value of the interrupt not between 0 and 15 (inclusive)
-// is mapped to zero. The default action of interrupt zero should be to stop
-// the machine but some operations may be performed before that.
+// the proper handler in the table indicated by status register 2. With the
+// default 16 handlers, any value of the interrupt not between 0 and 15
+// (inclusive) is mapped to zero, and likewise with a different number of
+// handlers. Note that, with fewer than five handlers, also some of the
+// interrupts raised by the hardware (e.g., IrqPageFault) are mapped to zero.
+// The default action of interrupt zero should be to stop the machine but
+// some operations may be performed before that.
 //
 // The following IRQs are defined:
 //
 // - IrqHALT (0): asks the OS to halt
 // - IrqClock (1): the clock needs attention
 // - IrqTTY (2): the TTY needs attention
+// - IrqDisk (3): the disk has completed a command
+// - IrqPageFault (4): a memory access caused a fault
 //
 // The IRET instruction implements returning from the interrupt.
 //
+// The hardware records the interrupts raised by devices into a bitmask of
+// pending interrupts, even when interrupts are disabled. When interrupts are
+// enabled, the hardware services the highest priority pending interrupt and
+// keeps the other ones pending. The lower the IRQ number, the higher the
+// priority, i.e., IrqHALT > IrqClock > IrqTTY > IrqDisk.
+//
 // Memory mapped I/O
 //
 // There is a bunch of memory locations reserved to memory mapped I/O (MMIO).
@@ -147,6 +213,16 @@
 // - MMClockFrequency (1<<17|0): this is the number of milliseconds after
 // which you want the clock to generate an interrupt.
 //
+// By default, the clock is periodic and generates an interrupt every time
+// the specified number of milliseconds elapses. When the ClockOneShot bit
+// (1<<31) is set, instead, the clock generates a single interrupt and then
+// the hardware clears MMClockFrequency, so the kernel must rearm it. Writing
+// zero into MMClockFrequency stops the clock.
+//
+// - MMClockTicks (1<<17|7): this is the number of times the clock has
+// generated an interrupt since boot. The counter is monotonically increasing
+// (modulo 1<<32) unless the kernel writes into it to reset it.
+//
 // TTY
 //
 // By default there is no attached TTY. If you attach a TTY before booting
@@ -173,86 +249,155 @@
 // word. The kernel should write into such word only if the TTYOut bit isn't
 // set. Then it should set the bit so that the hardware delivers the char. When
 // the delivery is complete, the hardware will clear TTYOut.
+//
+// Disk
+//
+// By default there is no attached disk. When there is an attached disk, the
+// following locations in memory will become useful for MMIO:
+//
+// - MMDiskSector (1<<17|4): number of the sector to transfer
+// - MMDiskBuffer (1<<17|5): physical address of the transfer buffer
+// - MMDiskControl (1<<17|6): command and status of the disk
+//
+// A sector is 512 bytes, i.e., 128 words, and the buffer is a region of
+// 128 words in memory. The MMDiskControl word contains these bits:
+//
+// - DiskRead (1<<0): read the sector into the buffer
+// - DiskWrite (1<<1): write the buffer into the sector
+// - DiskDone (1<<2): the disk has completed the command
+// - DiskError (1<<3): the command has failed
+//
+// To issue a command, the kernel writes the sector number and the buffer
+// address and then sets either DiskRead or DiskWrite. The disk transfers
+// the data, clears the command bit, and sets DiskDone (and possibly also
+// DiskError). This happens even if interrupts are disabled, so the kernel
+// may poll for DiskDone. The disk raises IrqDisk until the kernel clears
+// the DiskDone bit.
+//
+// Tracing
+//
+// When the TraceWriter field is set, Execute writes a line for each
+// instruction it executes. The line contains the address and the value
+// of the instruction, its disassembly, and the new value of the register
+// modified by the instruction, if any. For example:
+//
+//     pc=0x00000003 ci=0x10400005 insn="addi r1 r0 5" r1=0x00000005
+//
+// When an interrupt occurs, we also write a line containing the interrupt
+// code, the saved program counter, and the address of the handler, after
+// the line of the instruction during which the interrupt occurred, e.g.:
+//
+//     irq=1 ipc=0x00000004 handler=0x00000200
+//
+// The format of these lines is stable, so they are suitable for diffing
+// the execution of a program against a previous execution.
 package vm
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/bassosimone/risc32/pkg/spec"
 )
 
-// The following constants define the opcodes. We have 5 bits to define
-// opcodes, so up to 32 opcodes. While the opcodes here are related to
-// the ones of RiSC-16, here we have more opcodes and also their values
-// aren't necessarily aligned with the RiSC-16 architecture ones.
+// The following constants define the opcodes (see the spec package).
 const (
-	// RiSC-16 like operations -- note that JALR is the first operation
-	// so that zero initialized memory stops the VM when we are not using
-	// interrupts, which is a quite handy feature.
-	OpcodeJALR = uint32(iota)
-
-	OpcodeADD
-	OpcodeADDI
-	OpcodeNAND
-	OpcodeLUI
-	OpcodeSW
-	OpcodeLW
-	OpcodeBEQ
-
-	// Extended operations
-	OpcodeWSR
-	OpcodeRSR
-	OpcodeIRET
+	OpcodeJALR = spec.OpcodeJALR
+	OpcodeADD  = spec.OpcodeADD
+	OpcodeADDI = spec.OpcodeADDI
+	OpcodeNAND = spec.OpcodeNAND
+	OpcodeLUI  = spec.OpcodeLUI
+	OpcodeSW   = spec.OpcodeSW
+	OpcodeLW   = spec.OpcodeLW
+	OpcodeBEQ  = spec.OpcodeBEQ
+	OpcodeWSR  = spec.OpcodeWSR
+	OpcodeRSR  = spec.OpcodeRSR
+	OpcodeIRET = spec.OpcodeIRET
 )
 
 const (
-	// MemorySize is the memory size in 32-bit-wide words.
-	MemorySize = 1 << 20
+	// MemorySize is the default memory size in 32-bit-wide words. Use
+	// NewVM to create a virtual machine with a different memory size.
+	MemorySize = spec.MemorySize
 
 	// NumRegisters is the number of available general purpose
 	// registers. The programmer should honour the same semantics
 	// generally used by MIPS for such registers. R0 is always
 	// zero and its value cannot be changed.
-	NumRegisters = 32
+	NumRegisters = spec.NumRegisters
 
 	// NumStatusRegisters is the number of status registers.
-	NumStatusRegisters = 4
+	NumStatusRegisters = 5
+
+	// NumPageTableEntries is the number of entries in the page table.
+	NumPageTableEntries = 1 << 10
+
+	// NumInterrupts is the default number of entries in the interrupt
+	// table. Use the NI field of the VM to change it.
+	NumInterrupts = 16
+
+	// MaxInterruptNesting is the maximum number of nested interrupts.
+	MaxInterruptNesting = 8
 )
 
 // The following constants define bits in status register 0.
 const (
-	StatusUserMode = (1 << iota)
-	StatusPaging
-	StatusInterrupts
-	StatusDebugStepping
-	StatusDebugTracing
+	StatusUserMode      = spec.StatusUserMode
+	StatusPaging        = spec.StatusPaging
+	StatusInterrupts    = spec.StatusInterrupts
+	StatusDebugStepping = spec.StatusDebugStepping
+	StatusDebugTracing  = spec.StatusDebugTracing
 )
 
+// StatusFlags contains all the flags defined in status register 0. The
+// other bits of status register 0 are reserved.
+const StatusFlags = StatusUserMode | StatusPaging | StatusInterrupts |
+	StatusDebugStepping | StatusDebugTracing
+
 // The following constants define memory flags.
 const (
-	MemoryExec = (1 << iota)
-	MemoryWrite
-	MemoryRead
+	MemoryExec     = spec.MemoryExec
+	MemoryWrite    = spec.MemoryWrite
+	MemoryRead     = spec.MemoryRead
+	MemoryAccessed = spec.MemoryAccessed
+	MemoryDirty    = spec.MemoryDirty
 )
 
 // The following constants define interrupt requests.
 const (
-	IrqHALT = iota
-	IrqClock
-	IrqTTY
+	IrqHALT      = spec.IrqHALT
+	IrqClock     = spec.IrqClock
+	IrqTTY       = spec.IrqTTY
+	IrqDisk      = spec.IrqDisk
+	IrqPageFault = spec.IrqPageFault
 )
 
+// ClockOneShot is the MMClockFrequency bit selecting one-shot mode.
+const ClockOneShot = spec.ClockOneShot
+
 // The following constants define memory mapped addresses.
 const (
-	MMClockFrequency = 1<<17 | iota
-	MMTTYStatus
-	MMTTYIn
-	MMTTYOut
+	MMClockFrequency = spec.MMClockFrequency
+	MMTTYStatus      = spec.MMTTYStatus
+	MMTTYIn          = spec.MMTTYIn
+	MMTTYOut         = spec.MMTTYOut
+	MMDiskSector     = spec.MMDiskSector
+	MMDiskBuffer     = spec.MMDiskBuffer
+	MMDiskControl    = spec.MMDiskControl
+	MMClockTicks     = spec.MMClockTicks
 )
 
 // TTY is any teletype attached to the VM.
@@ -263,44 +408,449 @@ type TTY interface {
 	OutRegister() (*uint32, error)
 }
 
+// Disk is any block device attached to the VM. The VM calls
+// InterruptPending after executing each instruction, passing it the
+// physical memory, so that the disk can perform pending transfers.
+type Disk interface {
+	InterruptPending(mem []uint32) (bool, error)
+	SectorRegister() (*uint32, error)
+	BufferRegister() (*uint32, error)
+	ControlRegister() (*uint32, error)
+}
+
+// Tracer observes the execution of instructions. Execute calls
+// BeforeExecute before executing ci, when the PC already points to the
+// next instruction, and AfterExecute after executing ci, passing it the
+// error returned by Execute, if any. This allows to implement, e.g.,
+// coverage collection or call stack reconstruction. A Tracer should
+// not modify the VM, and must not call Execute.
+type Tracer interface {
+	BeforeExecute(vm *VM, ci uint32)
+	AfterExecute(vm *VM, ci uint32, err error)
+}
+
+// InterruptTracer is an optional interface that a Tracer may implement
+// to be notified before the VM transfers control to the handler of the
+// interrupt with the given code. At this point, the VM state is still
+// the one preceding the interrupt. This allows a debugger, e.g., to pause
+// before stepping into an interrupt service routine.
+type InterruptTracer interface {
+	BeforeInterrupt(vm *VM, code uint32)
+}
+
+// InterruptFrame is the state saved by an interrupt, which
+// IRET restores. See "Interrupts" in the package docs.
+type InterruptFrame struct {
+	PC uint32 `json:"pc"` // saved program counter
+	S0 uint32 `json:"s0"` // saved S[0]
+	SP uint32 `json:"sp"` // saved GPR[29]
+}
+
 // VM is a virtual machine instance. The virtual machine is not
 // goroutine safe; a single goroutine should manage it.
 type VM struct {
-	CF  uint32                     // clock frequency
-	GPR [NumRegisters]uint32       // general purpose registers
-	IPC uint32                     // saved program counter during interrupt
-	IS0 uint32                     // saved S[0] during interrupt
-	ISP uint32                     // saved GPR[29] during interrupt
-	LTR time.Time                  // last time record
-	M   [MemorySize]uint32         // memory
-	PC  uint32                     // program counter
-	S   [NumStatusRegisters]uint32 // status registers
-	TTY TTY                        // terminal
+	CF    uint32                     // clock frequency
+	Clock Clock                      // clock (nil means SystemClock)
+	CT    uint32                     // clock ticks
+	Disk  Disk                       // disk
+	GPR   [NumRegisters]uint32       // general purpose registers
+	IN    uint32                     // interrupt nesting depth
+	IPC   uint32                     // saved program counter during interrupt
+	IS0   uint32                     // saved S[0] during interrupt
+	ISP   uint32                     // saved GPR[29] during interrupt
+	IST   []InterruptFrame           // saved state of outer nested interrupts
+	LTR   time.Time                  // last time record
+	M     []uint32                   // memory (allocated lazily)
+	MS    uint32                     // memory size in words (zero means MemorySize)
+	NI    uint32                     // interrupt table entries (zero means NumInterrupts)
+	PC    uint32                     // program counter
+	PI    uint32                     // pending interrupts bitmask
+	S     [NumStatusRegisters]uint32 // status registers
+	TTY   TTY                        // terminal
+
+	// TraceWriter, when not nil, is where Execute writes a trace line
+	// for each executed instruction. See the package documentation for
+	// the format of trace lines. Errors writing traces are ignored.
+	TraceWriter io.Writer
+
+	// Tracer, when not nil, is notified before and after Execute
+	// executes each instruction. See the Tracer documentation.
+	Tracer Tracer
+
+	// StackLimit is the lowest valid address of the interrupt stack. When
+	// it is not zero, SW and LW using r29 as base register in kernel mode
+	// fail with ErrStackOverflow unless the address is between StackLimit
+	// and S[3] (inclusive). Zero, the default, disables this check.
+	StackLimit uint32
+
+	// StrictR0, when true, causes Execute to fail with ErrWriteR0 when
+	// ADD, ADDI, NAND, LUI, LW, or RSR use r0 as destination, which is
+	// most likely a bug since the result is discarded. We still allow
+	// `add r0 r0 r0` (i.e., nop) and JALR using r0 (i.e., jumps).
+	StrictR0 bool
+
+	// DetectSpinLoops, when true, causes Execute to fail with ErrSpinLoop
+	// when a BEQ branches to itself (e.g., `beq r0 r0 .`) while interrupts
+	// are disabled, since nothing could ever break such a loop. This is
+	// useful to stop test programs ending with a spin loop. We don't do
+	// that by default because kernels may spin waiting for interrupts.
+	DetectSpinLoops bool
+
+	// PoisonMemory, when true, causes PhysicalMemory and Reset to fill
+	// the memory with PoisonWord rather than with zero, and Execute to fail
+	// with ErrPoison when executing PoisonWord. This helps to catch jumps
+	// into uninitialized memory, which would otherwise halt, and programs
+	// assuming that memory is zeroed. Set it before using the memory.
+	PoisonMemory bool
+
+	// LenientOpcodes, when true, causes Execute to treat instructions with
+	// an unknown opcode as no-ops, which was the historical behavior. By
+	// default, instead, Execute fails with ErrBadInstruction, since such
+	// instructions most likely indicate that memory is corrupted.
+	LenientOpcodes bool
+
+	// OpcodeCounts counts how many times Execute has executed each
+	// opcode. See ProfileReport for a human readable summary.
+	OpcodeCounts [32]uint64
+
+	executing bool          // whether we're inside Execute
+	irqTrace  []string      // trace lines of the interrupts occurred in Execute
+	loaded    []loadedRange // memory ranges written by loaders (see Load)
+}
+
+// loadedRange is a range of physical memory written by a loader.
+type loadedRange struct {
+	addr uint32 // first address of the range
+	end  uint64 // address following the range
+}
+
+// NewVM creates a new virtual machine with memWords words of memory. When
+// memWords is zero, we use MemorySize. Note that the memory mapped addresses
+// (e.g., MMTTYOut) do not depend on the memory size, so they also work
+// with small memories. A zero VM is equivalent to NewVM(MemorySize).
+func NewVM(memWords uint32) *VM {
+	return &VM{MS: memWords}
+}
+
+// MemoryWords returns the size of the physical memory in words.
+func (vm *VM) MemoryWords() uint32 {
+	if vm.MS == 0 {
+		return MemorySize
+	}
+	return vm.MS
+}
+
+// Interrupts returns the number of entries in the interrupt table.
+func (vm *VM) Interrupts() uint32 {
+	if vm.NI == 0 {
+		return NumInterrupts
+	}
+	return vm.NI
 }
 
+// PoisonWord is the word used to fill memory when PoisonMemory is set. Its
+// opcode is 31, which does not correspond to any valid instruction.
+const PoisonWord = 0xffff_ffff
+
 // The following errors may be returned.
 var (
+	// ErrBadAlignment indicates that we attempted to write into a status
+	// register a value that is not properly aligned.
+	ErrBadAlignment = errors.New("vm: bad alignment")
+
+	// ErrBadInstruction indicates that we executed an
+	// instruction whose opcode is unknown.
+	ErrBadInstruction = errors.New("vm: bad instruction")
+
+	// ErrImageTooLarge indicates that the bytecode we're
+	// loading does not fit into the memory.
+	ErrImageTooLarge = errors.New("vm: image too large")
+
+	// ErrChecksum indicates that the checksum of the bytecode
+	// does not match the checksum of the words we have read.
+	ErrChecksum = errors.New("vm: checksum mismatch")
+
 	// ErrHalted indicates that the VM has been halted.
 	ErrHalted = errors.New("vm: halted")
 
+	// ErrInvalidRegister indicates that a register does not exist.
+	ErrInvalidRegister = errors.New("vm: invalid register")
+
+	// ErrInvariant indicates that CheckInvariants found the VM
+	// in a state in which it should never be.
+	ErrInvariant = errors.New("vm: invariant violated")
+
+	// ErrOverlappingLoad indicates that we attempted to load
+	// words into memory already written by a previous load.
+	ErrOverlappingLoad = errors.New("vm: overlapping load")
+
 	// ErrNotPermitted indicates that a given operation is not permitted.
 	ErrNotPermitted = errors.New("vm: operation not permitted")
 
+	// ErrPoison indicates that we executed PoisonWord, most likely
+	// because the program jumped into uninitialized memory.
+	ErrPoison = errors.New("vm: executing uninitialized memory")
+
+	// ErrSpinLoop indicates that the VM is stuck into a BEQ that branches
+	// to itself with interrupts disabled and DetectSpinLoops is enabled. It
+	// wraps ErrHalted, hence Run and RunContext return nil in such case.
+	ErrSpinLoop = fmt.Errorf("%w: spin loop", ErrHalted)
+
+	// ErrReservedBits indicates that we attempted to set reserved
+	// bits of status register 0 (see StatusFlags).
+	ErrReservedBits = errors.New("vm: reserved bits")
+
 	// ErrSIGSEGV indicates that we accessed an out of bound address.
 	ErrSIGSEGV = errors.New("vm: segmentation fault")
+
+	// ErrStackOverflow indicates that we accessed the interrupt stack
+	// outside of the bounds configured using StackLimit.
+	ErrStackOverflow = errors.New("vm: stack overflow")
+
+	// ErrTooManyNestedInterrupts indicates that an interrupt would
+	// exceed MaxInterruptNesting nested interrupts.
+	ErrTooManyNestedInterrupts = errors.New("vm: too many nested interrupts")
+
+	// ErrWriteR0 indicates that an instruction would have written
+	// into r0 and the StrictR0 mode is enabled.
+	ErrWriteR0 = errors.New("vm: write to r0")
 )
 
+// HaltError is the error returned when the VM halts. It wraps either
+// ErrHalted or ErrSpinLoop, which also wraps ErrHalted, hence you can
+// always use errors.Is(err, ErrHalted) to check whether the VM halted.
+//
+// Note that the VM halts when executing `jalr r0 r0 N` with interrupts
+// disabled, where N is zero (i.e., halt) or any other code. When interrupts
+// are enabled, the same instruction raises the N interrupt instead, and it
+// is up to the kernel to halt the VM, e.g., when handling IrqHALT.
+type HaltError struct {
+	Err    error  // either ErrHalted or ErrSpinLoop
+	PC     uint32 // address of the instruction that halted the VM
+	Reason string // why the VM halted (e.g., "halt")
+}
+
+// Error implements error.Error.
+func (err *HaltError) Error() string {
+	return fmt.Sprintf("%s: %s at 0x%08x", err.Err.Error(), err.Reason, err.PC)
+}
+
+// Unwrap allows to unwrap the underlying error.
+func (err *HaltError) Unwrap() error {
+	return err.Err
+}
+
+// Reset resets the VM to its initial state, so that it can be reused to
+// run another program without allocating a new VM. This function zeroes
+// the registers, the saved interrupt state, the clock, the OpcodeCounts,
+// and the memory (or fills it with PoisonWord if PoisonMemory is set). It
+// does not detach the TTY, which remains attached to the VM.
+func (vm *VM) Reset() {
+	vm.CF = 0
+	vm.CT = 0
+	vm.GPR = [NumRegisters]uint32{}
+	vm.IN = 0
+	vm.IPC = 0
+	vm.IS0 = 0
+	vm.ISP = 0
+	vm.IST = nil
+	vm.loaded = nil
+	vm.LTR = time.Time{}
+	vm.fillMemory()
+	vm.OpcodeCounts = [32]uint64{}
+	vm.PC = 0
+	vm.PI = 0
+	vm.S = [NumStatusRegisters]uint32{}
+}
+
+// CheckInvariants checks whether the VM is in a consistent state and
+// returns an error wrapping ErrInvariant otherwise. It is meant to be
+// called after Execute when fuzzing or testing the VM. We check that r0
+// is zero, that the PC is inside the address space (i.e., the physical
+// memory or, when paging is enabled, the virtual address space, which may
+// be larger than the physical memory), that S[0] only has defined flags
+// set, and that the S[1], S[2], and S[3] addresses are 1<<10 aligned. Note
+// that a buggy program may also break the PC invariant by jumping.
+func (vm *VM) CheckInvariants() error {
+	if vm.GPR[0] != 0 {
+		return fmt.Errorf("%w: r0 is 0x%08x", ErrInvariant, vm.GPR[0])
+	}
+	limit := uint64(vm.MemoryWords())
+	if (vm.S[0] & StatusPaging) != 0 {
+		limit = NumPageTableEntries << 10 // virtual address space
+	}
+	if uint64(vm.PC) >= limit {
+		return fmt.Errorf("%w: PC 0x%08x outside of the address space", ErrInvariant, vm.PC)
+	}
+	if (vm.S[0] &^ StatusFlags) != 0 {
+		return fmt.Errorf("%w: S[0] 0x%08x has reserved bits set", ErrInvariant, vm.S[0])
+	}
+	for idx := 1; idx <= 3; idx++ {
+		if (vm.S[idx] & 0b11_1111_1111) != 0 {
+			return fmt.Errorf("%w: S[%d] 0x%08x is not 1<<10 aligned",
+				ErrInvariant, idx, vm.S[idx])
+		}
+	}
+	return nil
+}
+
+// PhysicalMemory returns the physical memory of the VM. Because a VM
+// has MemoryWords words of memory, we only allocate it on first use, so
+// that creating a VM is cheap. Always use this function rather than
+// accessing the M field directly, because M may not be allocated yet.
+func (vm *VM) PhysicalMemory() []uint32 {
+	if vm.M == nil {
+		vm.M = make([]uint32, vm.MemoryWords())
+		vm.fillMemory()
+	}
+	return vm.M
+}
+
+// fillMemory zeroes the memory or fills it with PoisonWord.
+func (vm *VM) fillMemory() {
+	var word uint32
+	if vm.PoisonMemory {
+		word = PoisonWord
+	}
+	for idx := range vm.M {
+		vm.M[idx] = word
+	}
+}
+
+// FaultError is the error returned when accessing memory fails. It
+// wraps either ErrSIGSEGV or ErrNotPermitted, so you can use errors.Is
+// to check the kind of fault and errors.As to inspect its details.
+type FaultError struct {
+	Err        error  // either ErrSIGSEGV or ErrNotPermitted
+	Fetch      bool   // whether we were fetching an instruction
+	Flags      uint32 // attempted access (e.g., MemoryRead|MemoryExec)
+	Missing    uint32 // flags missing from the page (with ErrNotPermitted)
+	Physical   uint32 // physical address (only valid if Translated)
+	Reason     string // reason why the access failed
+	Translated bool   // whether we translated Virtual to Physical
+	Virtual    uint32 // address we attempted to access
+}
+
+// Error implements error.Error.
+func (err *FaultError) Error() string {
+	s := fmt.Sprintf("%s: %s (virtual: %#x", err.Err.Error(), err.Reason, err.Virtual)
+	if err.Translated {
+		s += fmt.Sprintf(", physical: %#x", err.Physical)
+	}
+	s += fmt.Sprintf(", flags: %#03b", err.Flags)
+	if err.Missing != 0 {
+		s += fmt.Sprintf(", missing: %#03b", err.Missing)
+	}
+	if err.Fetch {
+		s += ", fetch"
+	}
+	return s + ")"
+}
+
+// Unwrap allows to unwrap the underlying error.
+func (err *FaultError) Unwrap() error {
+	return err.Err
+}
+
 // StatusDebug returns the stepping and/or tracing flags.
 func (vm *VM) StatusDebug() uint32 {
 	return vm.S[0] & (StatusDebugTracing | StatusDebugStepping)
 }
 
+// ReadMem reads the word at the addr physical address. Unlike Memory,
+// which accesses virtual addresses on behalf of the running program, this
+// function bypasses MMIO and paging, so it is suitable for debuggers.
+func (vm *VM) ReadMem(addr uint32) (uint32, error) {
+	if addr >= vm.MemoryWords() {
+		return 0, &FaultError{Err: ErrSIGSEGV, Flags: MemoryRead, Physical: addr,
+			Reason: "address above physical memory", Virtual: addr}
+	}
+	return vm.PhysicalMemory()[addr], nil
+}
+
+// WriteMem is like ReadMem but writes value at the addr physical address.
+func (vm *VM) WriteMem(addr, value uint32) error {
+	if addr >= vm.MemoryWords() {
+		return &FaultError{Err: ErrSIGSEGV, Flags: MemoryWrite, Physical: addr,
+			Reason: "address above physical memory", Virtual: addr}
+	}
+	vm.PhysicalMemory()[addr] = value
+	return nil
+}
+
+// Load copies words into the physical memory starting from addr. We record
+// the range of memory written by each load (including LoadData and
+// LoadWordsAt), so that loading several images and data blocks cannot
+// silently corrupt each other. This function fails with ErrImageTooLarge if
+// the words do not fit into memory and with ErrOverlappingLoad if they would
+// overwrite words written by a previous load. Reset forgets the ranges.
+func (vm *VM) Load(words []uint32, addr uint32) error {
+	end := uint64(addr) + uint64(len(words))
+	if end > uint64(vm.MemoryWords()) {
+		return fmt.Errorf("%w: %d words at %#x", ErrImageTooLarge, len(words), addr)
+	}
+	if len(words) == 0 {
+		return nil // nothing to load
+	}
+	for _, r := range vm.loaded {
+		if uint64(addr) < r.end && uint64(r.addr) < end {
+			return fmt.Errorf("%w: [%#x, %#x) overlaps with [%#x, %#x)",
+				ErrOverlappingLoad, addr, end, r.addr, r.end)
+		}
+	}
+	copy(vm.PhysicalMemory()[addr:], words)
+	vm.loaded = append(vm.loaded, loadedRange{addr: addr, end: end})
+	return nil
+}
+
+// LoadData reads raw bytes from r and stores them into the physical memory
+// starting from addr using Load. Each four bytes become a little endian
+// word, and we pad the last word with zeros. This function fails with
+// ErrImageTooLarge if the data does not fit into memory and with
+// ErrOverlappingLoad if the data overlaps with a previous load.
+func (vm *VM) LoadData(r io.Reader, addr uint32) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	words := make([]uint32, len(data)/4)
+	for idx := 0; idx < len(data); idx += 4 {
+		words[idx/4] = binary.LittleEndian.Uint32(data[idx:])
+	}
+	return vm.Load(words, addr)
+}
+
+// GetReg returns the value of the reg general purpose register.
+func (vm *VM) GetReg(reg uint32) (uint32, error) {
+	if reg >= NumRegisters {
+		return 0, fmt.Errorf("%w: r%d", ErrInvalidRegister, reg)
+	}
+	return vm.GPR[reg], nil
+}
+
+// SetReg sets the value of the reg general purpose register. Because r0
+// is always zero, this function ignores the value when reg is zero.
+func (vm *VM) SetReg(reg, value uint32) error {
+	if reg >= NumRegisters {
+		return fmt.Errorf("%w: r%d", ErrInvalidRegister, reg)
+	}
+	if reg != 0 {
+		vm.GPR[reg] = value
+	}
+	return nil
+}
+
 // Memory accesses an address in memory
 func (vm *VM) Memory(off uint32, flags uint32) (*uint32, error) {
 	// Implement memory mapped I/O
 	switch off {
 	case MMClockFrequency:
 		return &vm.CF, nil
+	case MMClockTicks:
+		return &vm.CT, nil
 	}
 	if vm.TTY != nil {
 		switch off {
@@ -312,38 +862,79 @@ func (vm *VM) Memory(off uint32, flags uint32) (*uint32, error) {
 			return vm.TTY.OutRegister()
 		}
 	}
+	if vm.Disk != nil {
+		switch off {
+		case MMDiskSector:
+			return vm.Disk.SectorRegister()
+		case MMDiskBuffer:
+			return vm.Disk.BufferRegister()
+		case MMDiskControl:
+			return vm.Disk.ControlRegister()
+		}
+	}
+	fault := &FaultError{Flags: flags, Virtual: off}
+	var pte *uint32 // page table entry (only when paging)
 	if (vm.S[0] & StatusPaging) != 0 {
 		if (vm.S[1] & 0b11_1111_1111) != 0 {
-			return nil, fmt.Errorf("%w: invalid page table base address", ErrSIGSEGV)
+			fault.Err, fault.Reason = ErrSIGSEGV, "invalid page table base address"
+			return nil, fault
 		}
 		pageid := off >> 10
+		if pageid >= NumPageTableEntries {
+			fault.Err, fault.Reason = ErrSIGSEGV, "page id beyond the page table"
+			return nil, fault
+		}
 		pageoff := vm.S[1] + pageid
-		if pageoff >= MemorySize {
-			return nil, fmt.Errorf("%w: page entry above physical memory", ErrSIGSEGV)
+		if pageoff >= vm.MemoryWords() {
+			fault.Err, fault.Reason = ErrSIGSEGV, "page entry above physical memory"
+			return nil, fault
 		}
-		pageinfo := vm.M[pageoff]
+		pageinfo := vm.PhysicalMemory()[pageoff]
 		pageflags := pageinfo & 0b111_1111
-		if (pageflags & flags) != flags {
-			return nil, fmt.Errorf("%w: memory flags mismatch", ErrNotPermitted)
-		}
 		membase := pageinfo & 0b1111_1111_1111_1111_1111_11_00_0000_0000
 		memoff := off & 0b0000_0000_0000_0000_0000_00_11_1111_1111
 		off = membase + memoff
+		fault.Physical, fault.Translated = off, true
+		if (pageflags & flags) != flags {
+			fault.Err, fault.Reason = ErrNotPermitted, "memory flags mismatch"
+			fault.Missing = flags &^ pageflags
+			return nil, fault
+		}
+		pte = &vm.PhysicalMemory()[pageoff]
 		// fallthrough
 	}
-	if off >= MemorySize {
-		return nil, ErrSIGSEGV
+	if off >= vm.MemoryWords() {
+		fault.Err, fault.Reason = ErrSIGSEGV, "address above physical memory"
+		return nil, fault
 	}
-	return &vm.M[off], nil
+	if pte != nil {
+		*pte |= MemoryAccessed
+		if (flags & MemoryWrite) != 0 {
+			*pte |= MemoryDirty
+		}
+	}
+	return &vm.PhysicalMemory()[off], nil
 }
 
 // Fetch fetches the next instruction, returns it, and increments
-// the vm.PC program counter of the virtual machine.
+// the vm.PC program counter of the virtual machine. When fetching fails
+// because of a memory fault, the FaultError has the Fetch flag set and,
+// if the page is not executable, MemoryExec in its Missing flags.
 func (vm *VM) Fetch() (uint32, error) {
 	ci, err := vm.Memory(vm.PC, MemoryRead|MemoryExec)
 	if err != nil {
-		return 0, err
+		var fault *FaultError
+		if errors.As(err, &fault) {
+			fault.Fetch = true
+		}
+		if err := vm.maybePageFault(err, vm.PC); err != nil {
+			return 0, err
+		}
+		return vm.Fetch() // fetch the first instruction of the handler
 	}
+	// Note: the PC cannot wrap around here, because fetching succeeds
+	// only for addresses below MemoryWords (or the size of the virtual
+	// address space), so we fault before reaching math.MaxUint32.
 	vm.PC++
 	return *ci, nil
 }
@@ -354,6 +945,158 @@ func (vm *VM) String() string {
 	return s
 }
 
+// RegistersString is like String except that it only prints the general
+// purpose registers, one per line, as hexadecimal, unsigned decimal, and
+// signed decimal numbers, which helps when debugging arithmetic, e.g.:
+//
+//     r5  0xffffffff 4294967295 -1
+func (vm *VM) RegistersString() string {
+	var b strings.Builder
+	for idx, value := range vm.GPR {
+		fmt.Fprintf(&b, "r%-2d 0x%08x %d %d\n", idx, value, value, int32(value))
+	}
+	return b.String()
+}
+
+// ProfileReport returns a report of the OpcodeCounts containing, for each
+// executed opcode, a line with the mnemonic and the count, sorted by
+// descending count, e.g.:
+//
+//     addi 1024
+//     beq 512
+func (vm *VM) ProfileReport() string {
+	var opcodes []uint32
+	for opcode, count := range vm.OpcodeCounts {
+		if count > 0 {
+			opcodes = append(opcodes, uint32(opcode))
+		}
+	}
+	sort.SliceStable(opcodes, func(i, j int) bool {
+		return vm.OpcodeCounts[opcodes[i]] > vm.OpcodeCounts[opcodes[j]]
+	})
+	var b strings.Builder
+	for _, opcode := range opcodes {
+		// Use the mnemonic printed by Disassemble for this opcode.
+		name := strings.Fields(Disassemble(opcode << 27))[0]
+		if strings.HasPrefix(name, "<") {
+			name = fmt.Sprintf("opcode%d", opcode)
+		}
+		fmt.Fprintf(&b, "%s %d\n", name, vm.OpcodeCounts[opcode])
+	}
+	return b.String()
+}
+
+// State is a snapshot of the VM registers and of the memory configuration,
+// excluding the memory content. The JSON names of the fields are stable,
+// so tools can depend on them.
+type State struct {
+	CF     uint32                     `json:"cf"`     // clock frequency
+	GPR    [NumRegisters]uint32       `json:"gpr"`    // general purpose registers
+	IN     uint32                     `json:"in"`     // interrupt nesting depth
+	IPC    uint32                     `json:"ipc"`    // saved program counter
+	IS0    uint32                     `json:"is0"`    // saved S[0]
+	ISP    uint32                     `json:"isp"`    // saved GPR[29]
+	IST    []InterruptFrame           `json:"ist"`    // outer nested interrupts
+	MS     uint32                     `json:"ms"`     // memory size in words
+	PC     uint32                     `json:"pc"`     // program counter
+	Poison bool                       `json:"poison"` // whether PoisonMemory is set
+	S      [NumStatusRegisters]uint32 `json:"s"`      // status registers
+}
+
+// State returns a snapshot of the VM registers.
+func (vm *VM) State() State {
+	return State{
+		CF:     vm.CF,
+		GPR:    vm.GPR,
+		IN:     vm.IN,
+		IPC:    vm.IPC,
+		IS0:    vm.IS0,
+		ISP:    vm.ISP,
+		IST:    append([]InterruptFrame{}, vm.IST...),
+		MS:     vm.MemoryWords(),
+		PC:     vm.PC,
+		Poison: vm.PoisonMemory,
+		S:      vm.S,
+	}
+}
+
+// StateJSON returns the JSON serialization of vm.State(). Unlike
+// String, the output format of this function is stable.
+func (vm *VM) StateJSON() ([]byte, error) {
+	return json.Marshal(vm.State())
+}
+
+// CoreState is the prefix of the line of a core dump containing
+// the JSON serialization of the State. See WriteCore.
+const CoreState = "# state:"
+
+// WriteCore writes a core dump of the VM into w. The core dump uses the
+// bytecode format, so you can inspect it using a disassembler. It contains
+// the physical memory up to the last word that differs from the word used
+// to fill unused memory (i.e., zero or, if PoisonMemory is set, PoisonWord),
+// the PC as the entry point, and a comment line containing the State
+// serialized as JSON:
+//
+//     # entry: 0x00000005
+//     # state: {"cf":0,"gpr":[0,1,...],...}
+//     0x10400001
+//     ...
+//
+// Use LoadCore to load a core dump into a new VM.
+func (vm *VM) WriteCore(w io.Writer) error {
+	state, err := vm.StateJSON()
+	if err != nil {
+		return err
+	}
+	var filler uint32
+	if vm.PoisonMemory {
+		filler = PoisonWord
+	}
+	mem := vm.PhysicalMemory()
+	end := len(mem)
+	for end > 0 && mem[end-1] == filler {
+		end--
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s 0x%08x\n%s %s\n", BytecodeEntry, vm.PC, CoreState, state)
+	for _, word := range mem[:end] {
+		fmt.Fprintf(bw, "0x%08x\n", word)
+	}
+	return bw.Flush()
+}
+
+// LoadCore loads a core dump written by WriteCore and returns a virtual
+// machine instance with the same memory size, memory, and registers.
+func LoadCore(r io.Reader) (*VM, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	words, entry, err := ReadBytecodeWithEntry(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	state := State{PC: entry} // in case the state is missing
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, CoreState) {
+			err := json.Unmarshal([]byte(strings.TrimPrefix(line, CoreState)), &state)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	vm := NewVM(state.MS)
+	vm.PoisonMemory = state.Poison
+	if err := vm.Load(words, 0); err != nil {
+		return nil, err
+	}
+	vm.CF, vm.GPR, vm.IPC, vm.IS0 = state.CF, state.GPR, state.IPC, state.IS0
+	vm.ISP, vm.PC, vm.S = state.ISP, state.PC, state.S
+	vm.IN, vm.IST = state.IN, state.IST
+	return vm, nil
+}
+
 // DecodeOpcode decodes the opcode of an instruction.
 func DecodeOpcode(ci uint32) uint32 {
 	return (ci >> 27) & 0b1_1111
@@ -390,6 +1133,20 @@ func Decode(ci uint32) (opcode, ra, rb, rc, imm17, imm22 uint32) {
 		DecodeImm17(ci), DecodeImm22(ci)
 }
 
+// maybePageFault handles the err that occurred while executing the
+// instruction at pc. If err is a FaultError and interrupts are enabled,
+// we raise an IrqPageFault interrupt and return its result. Otherwise, we
+// return the original error, which will most likely stop the VM.
+func (vm *VM) maybePageFault(err error, pc uint32) error {
+	var fault *FaultError
+	if (vm.S[0]&StatusInterrupts) == 0 || !errors.As(err, &fault) {
+		return err
+	}
+	vm.S[4] = fault.Virtual
+	vm.PC = pc // so that IRET executes the instruction again
+	return vm.Interrupt(IrqPageFault)
+}
+
 // Interrupt executes an interrupt service routine.
 func (vm *VM) Interrupt(code uint32) error {
 	log.Printf("vm: irq %d", code)
@@ -399,43 +1156,99 @@ func (vm *VM) Interrupt(code uint32) error {
 	if (vm.S[3] & 0b11_1111_1111) != 0 {
 		return fmt.Errorf("%w: invalid interrupt stack base address", ErrSIGSEGV)
 	}
-	if code >= 16 {
+	if uint64(vm.S[2])+uint64(vm.Interrupts()) > uint64(vm.MemoryWords()) {
+		return &FaultError{
+			Err:     ErrSIGSEGV,
+			Flags:   MemoryRead,
+			Reason:  "interrupt table above physical memory",
+			Virtual: vm.S[2],
+		}
+	}
+	if code >= vm.Interrupts() {
 		code = IrqHALT // the zero handler tells the kernel to HALT
 	}
+	if it, ok := vm.Tracer.(InterruptTracer); ok {
+		it.BeforeInterrupt(vm, code)
+	}
+	if vm.IN >= MaxInterruptNesting {
+		return ErrTooManyNestedInterrupts
+	}
+	if vm.IN > 0 {
+		// nested interrupt: save the state of the outer interrupt
+		vm.IST = append(vm.IST, InterruptFrame{PC: vm.IPC, S0: vm.IS0, SP: vm.ISP})
+	}
+	vm.IN++
 	// save state and switch to interrupt
 	vm.IS0 = vm.S[0]
 	vm.ISP = vm.GPR[29]
 	vm.IPC = vm.PC
-	// swap to kernel stack
-	vm.GPR[29] = vm.S[3]
+	// swap to kernel stack, unless we're already using it
+	if vm.IN == 1 {
+		vm.GPR[29] = vm.S[3]
+	}
 	// enter kernel mode with interrupt handling and paging disabled
 	vm.S[0] &^= StatusUserMode | StatusInterrupts | StatusPaging
-	// jump to ISR
-	off := vm.S[2] + code
-	if off >= MemorySize {
-		return ErrSIGSEGV
+	// jump to ISR (we have checked that the table is inside memory)
+	vm.PC = vm.PhysicalMemory()[vm.S[2]+code]
+	if vm.TraceWriter != nil {
+		line := fmt.Sprintf("irq=%d ipc=0x%08x handler=0x%08x", code, vm.IPC, vm.PC)
+		if vm.executing { // written by trace after the instruction line
+			vm.irqTrace = append(vm.irqTrace, line)
+		} else {
+			fmt.Fprintln(vm.TraceWriter, line)
+		}
 	}
-	vm.PC = vm.M[off]
 	return nil
 }
 
-// MaybeInterrupt checks whether there is any hardware that has
-// pending interrupts and services the highest priority one.
+// MaybeInterrupt polls the hardware for pending interrupts, which we
+// record into the PI bitmask, and, when interrupts are enabled, services
+// the highest priority pending interrupt. The lower the IRQ number, the
+// higher the priority, i.e., IrqHALT > IrqClock > IrqTTY > IrqDisk. The
+// other interrupts remain pending until we can service them.
 func (vm *VM) MaybeInterrupt() error {
-	if (vm.S[0] & StatusInterrupts) == 0 {
+	if err := vm.pollDevices(); err != nil {
+		return err
+	}
+	if (vm.S[0]&StatusInterrupts) == 0 || vm.PI == 0 {
 		return nil
 	}
+	for code := uint32(0); code < 32; code++ {
+		if (vm.PI & (1 << code)) != 0 {
+			vm.PI &^= 1 << code
+			return vm.Interrupt(code)
+		}
+	}
+	return nil
+}
+
+// now returns the current time according to the VM clock.
+func (vm *VM) now() time.Time {
+	if vm.Clock != nil {
+		return vm.Clock.Now()
+	}
+	return time.Now()
+}
+
+// pollDevices polls the hardware and records pending interrupts into PI.
+func (vm *VM) pollDevices() error {
 	// Clock
-	if vm.CF > 0 {
-		now := time.Now()
+	if millis := vm.CF &^ ClockOneShot; millis > 0 {
+		now := vm.now()
 		if vm.LTR.IsZero() {
 			vm.LTR = now
 		}
-		if now.Sub(vm.LTR).Milliseconds() >= int64(vm.CF) {
+		if now.Sub(vm.LTR).Milliseconds() >= int64(millis) {
 			vm.LTR = now
-			return vm.Interrupt(IrqClock)
+			vm.PI |= 1 << IrqClock
+			vm.CT++
+			if (vm.CF & ClockOneShot) != 0 {
+				vm.CF = 0 // the kernel must rearm the clock
+			}
 		}
 		// fallthrough
+	} else {
+		vm.LTR = time.Time{} // start counting again when armed
 	}
 	// TTY
 	if vm.TTY != nil {
@@ -444,18 +1257,84 @@ func (vm *VM) MaybeInterrupt() error {
 			return err
 		}
 		if ok {
-			return vm.Interrupt(IrqTTY)
+			vm.PI |= 1 << IrqTTY
+		}
+		// fallthrough
+	}
+	// Disk
+	if vm.Disk != nil {
+		ok, err := vm.Disk.InterruptPending(vm.PhysicalMemory())
+		if err != nil {
+			return err
+		}
+		if ok {
+			vm.PI |= 1 << IrqDisk
 		}
 		// fallthrough
 	}
 	return nil
 }
 
+// trace writes on the TraceWriter the trace line of the instruction ci
+// located at pc. We must call this function after executing ci.
+func (vm *VM) trace(pc, ci uint32) {
+	opcode, ra := DecodeOpcode(ci), DecodeRA(ci)
+	line := fmt.Sprintf("pc=0x%08x ci=0x%08x insn=%q", pc, ci, Disassemble(ci))
+	switch opcode {
+	case OpcodeADD, OpcodeADDI, OpcodeNAND, OpcodeLUI, OpcodeLW, OpcodeRSR,
+		OpcodeJALR:
+		if ra != 0 { // writing into r0 has no effect
+			line += fmt.Sprintf(" r%d=0x%08x", ra, vm.GPR[ra])
+		}
+	}
+	fmt.Fprintln(vm.TraceWriter, line)
+	for _, line := range vm.irqTrace {
+		fmt.Fprintln(vm.TraceWriter, line)
+	}
+	vm.executing, vm.irqTrace = false, nil
+}
+
+// checkStack checks whether accessing off using rb as the base register
+// is within the bounds of the interrupt stack. See StackLimit.
+func (vm *VM) checkStack(rb, off uint32) error {
+	if vm.StackLimit == 0 || rb != 29 || (vm.S[0]&StatusUserMode) != 0 {
+		return nil
+	}
+	if off < vm.StackLimit || off > vm.S[3] {
+		return fmt.Errorf("%w: address %#x outside of [%#x, %#x]",
+			ErrStackOverflow, off, vm.StackLimit, vm.S[3])
+	}
+	return nil
+}
+
 // Execute executes the current instruction ci. This function returns an
 // error when the processor has halted or a fault has occurred.
-func (vm *VM) Execute(ci uint32) error {
+func (vm *VM) Execute(ci uint32) (err error) {
 	// decode instruction
 	opcode, ra, rb, rc, imm17, imm22 := Decode(ci)
+	vm.OpcodeCounts[opcode]++
+	// trace the instruction after we have cleared r0 (defers are LIFO)
+	if vm.TraceWriter != nil {
+		vm.executing = true
+		defer vm.trace(vm.PC-1, ci)
+	}
+	if vm.Tracer != nil {
+		vm.Tracer.BeforeExecute(vm, ci)
+		defer func() {
+			vm.Tracer.AfterExecute(vm, ci, err)
+		}()
+	}
+	// in strict mode, refuse writing into r0 (except for nop)
+	if vm.StrictR0 && ra == 0 && ci != OpcodeADD<<27 {
+		switch opcode {
+		case OpcodeADD, OpcodeADDI, OpcodeNAND, OpcodeLUI, OpcodeLW, OpcodeRSR:
+			return fmt.Errorf("%w: %s", ErrWriteR0, Disassemble(ci))
+		}
+	}
+	// catch jumps into uninitialized (i.e., poisoned) memory
+	if vm.PoisonMemory && ci == PoisonWord {
+		return fmt.Errorf("%w at 0x%08x", ErrPoison, vm.PC-1)
+	}
 	// guarantee that r0 is always zero
 	defer func() {
 		vm.GPR[0] = 0
@@ -469,7 +1348,11 @@ func (vm *VM) Execute(ci uint32) error {
 			vm.GPR[ra] = vm.PC
 			vm.PC = vm.GPR[rb]
 		} else if (vm.S[0] & StatusInterrupts) == 0 {
-			return ErrHalted
+			reason := "halt"
+			if imm17 != 0 {
+				reason = fmt.Sprintf("trap %d with interrupts disabled", imm17)
+			}
+			return &HaltError{Err: ErrHalted, PC: vm.PC - 1, Reason: reason}
 		} else if err := vm.Interrupt(imm17); err != nil {
 			return err
 		}
@@ -483,6 +1366,9 @@ func (vm *VM) Execute(ci uint32) error {
 		vm.GPR[ra] = imm22 << 10
 	case OpcodeSW, OpcodeLW:
 		off := vm.GPR[rb] + imm17
+		if err := vm.checkStack(rb, off); err != nil {
+			return err
+		}
 		var flags uint32
 		switch opcode {
 		case OpcodeSW:
@@ -492,7 +1378,7 @@ func (vm *VM) Execute(ci uint32) error {
 		}
 		mptr, err := vm.Memory(off, flags)
 		if err != nil {
-			return err
+			return vm.maybePageFault(err, vm.PC-1)
 		}
 		switch opcode {
 		case OpcodeSW:
@@ -502,6 +1388,9 @@ func (vm *VM) Execute(ci uint32) error {
 		}
 	case OpcodeBEQ:
 		if vm.GPR[ra] == vm.GPR[rb] {
+			if vm.DetectSpinLoops && vm.PC+imm17 == vm.PC-1 && (vm.S[0]&StatusInterrupts) == 0 {
+				return &HaltError{Err: ErrSpinLoop, PC: vm.PC - 1, Reason: Disassemble(ci)}
+			}
 			vm.PC += imm17
 		}
 	case OpcodeWSR, OpcodeRSR:
@@ -513,6 +1402,18 @@ func (vm *VM) Execute(ci uint32) error {
 		}
 		switch opcode {
 		case OpcodeWSR:
+			// The page table, the interrupt table, and the interrupt
+			// stack must be aligned. We also check when using them, but
+			// failing here points the kernel developer to the real bug.
+			if imm22 >= 1 && imm22 <= 3 && (vm.GPR[ra]&0b11_1111_1111) != 0 {
+				return fmt.Errorf("%w: S[%d] value %#x is not 1<<10 aligned",
+					ErrBadAlignment, imm22, vm.GPR[ra])
+			}
+			// Note that the new S[0] applies starting from the next
+			// Fetch, which checks paging and permissions again.
+			if imm22 == 0 && (vm.GPR[ra]&^StatusFlags) != 0 {
+				return fmt.Errorf("%w: S[0] value %#x", ErrReservedBits, vm.GPR[ra])
+			}
 			vm.S[imm22] = vm.GPR[ra]
 		case OpcodeRSR:
 			vm.GPR[ra] = vm.S[imm22]
@@ -524,12 +1425,63 @@ func (vm *VM) Execute(ci uint32) error {
 		vm.S[0] = vm.IS0
 		vm.GPR[29] = vm.ISP
 		vm.PC = vm.IPC
+		if vm.IN > 0 {
+			vm.IN--
+		}
+		if n := len(vm.IST); n > 0 {
+			// restore the state of the outer interrupt
+			frame := vm.IST[n-1]
+			vm.IPC, vm.IS0, vm.ISP = frame.PC, frame.S0, frame.SP
+			vm.IST = vm.IST[:n-1]
+		}
+	default:
+		if !vm.LenientOpcodes {
+			return fmt.Errorf("%w: opcode %d at 0x%08x", ErrBadInstruction, opcode, vm.PC-1)
+		}
 	}
 	// After the execution of each instruction, check whether we have
 	// any other pending interrupt and service them.
 	return vm.MaybeInterrupt()
 }
 
+// Run runs the VM until it halts or a fault occurs. This function
+// returns nil when the VM halts and the fault error otherwise.
+func (vm *VM) Run() error {
+	return vm.RunContext(context.Background())
+}
+
+// RunContext is like Run but it also checks whether the context is done
+// before executing each instruction. In such case, it stops the VM and
+// returns the error of the context.
+func (vm *VM) RunContext(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			// fallthrough
+		}
+		if _, err := vm.Step(); err != nil {
+			if errors.Is(err, ErrHalted) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Step fetches and executes the next instruction and returns the value
+// of the instruction it has executed. When the VM halts, this function
+// returns the halt instruction along with ErrHalted. When fetching fails,
+// this function returns zero along with a FaultError (see Fetch).
+func (vm *VM) Step() (uint32, error) {
+	ci, err := vm.Fetch()
+	if err != nil {
+		return 0, err
+	}
+	return ci, vm.Execute(ci)
+}
+
 // SignExtend17 extends the sign to negative values over 17 bit.
 func SignExtend17(v uint32) uint32 {
 	if (v & 0b00000_00000_00000_1_0000_0000_0000_0000) != 0 {
@@ -539,7 +1491,10 @@ func SignExtend17(v uint32) uint32 {
 }
 
 // Disassemble disassembles a single instruction and returns valid
-// assembly code implementing such instruction.
+// assembly code implementing such instruction. We print the 17-bit
+// immediates of ADDI, SW, LW, BEQ, and JALR as signed numbers, consistently
+// with DecodeImm17, so that, e.g., `lw r1 r2 -4` disassembles to itself. The
+// 22-bit immediates of LUI, WSR, and RSR are unsigned.
 func Disassemble(ci uint32) string {
 	// decode instruction
 	opcode, ra, rb, rc, imm17, imm22 := Decode(ci)
@@ -575,24 +1530,138 @@ func Disassemble(ci uint32) string {
 // LoadBytecode loads bytecode from the specified io.Reader and returns a
 // virtual machine instance for running such bytecode.
 func LoadBytecode(r io.Reader) (*VM, error) {
+	return LoadBytecodeAt(r, 0)
+}
+
+// LoadBytecodeAt is like LoadBytecode except that it loads the bytecode
+// starting from the base address. The PC is set to the entry point of the
+// bytecode, if specified, and otherwise to zero. This function fails with
+// ErrImageTooLarge if the bytecode does not fit into memory. The returned
+// VM has MemorySize words of memory; to use another size, create the VM
+// using NewVM and call its LoadBytecode method.
+func LoadBytecodeAt(r io.Reader, base uint32) (*VM, error) {
+	vm := new(VM)
+	if err := vm.LoadBytecode(r, base); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// LoadBytecode reads bytecode from r and loads it into the memory of vm
+// starting from the base address using Load, hence it honours the memory
+// size of vm. On success, the PC is set to the entry point of the bytecode,
+// if specified, and otherwise to zero. This function fails with
+// ErrImageTooLarge if the bytecode does not fit into memory.
+func (vm *VM) LoadBytecode(r io.Reader, base uint32) error {
+	words, entry, err := ReadBytecodeWithEntry(r)
+	if err != nil {
+		return err
+	}
+	if err := vm.Load(words, base); err != nil {
+		return err
+	}
+	vm.PC = entry
+	return nil
+}
+
+// LoadWords returns a virtual machine instance whose memory contains
+// the given words starting from address zero. This is the in-memory
+// counterpart of LoadBytecode, which is useful to run programs embedded
+// into Go code (see the -go flag of cmd/asm). This function fails with
+// ErrImageTooLarge if the words do not fit into memory.
+func LoadWords(words []uint32) (*VM, error) {
+	return LoadWordsAt(words, 0)
+}
+
+// LoadWordsAt is like LoadWords except that it copies the words into
+// memory starting from the base address. The returned VM has MemorySize
+// words of memory; to use another size, call Load on a VM created
+// using NewVM.
+func LoadWordsAt(words []uint32, base uint32) (*VM, error) {
 	vm := new(VM)
+	if err := vm.Load(words, base); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// ReadBytecode reads bytecode from the specified io.Reader and returns
+// the sequence of words it contains, in the order they should be loaded
+// into memory starting from address zero.
+func ReadBytecode(r io.Reader) ([]uint32, error) {
+	words, _, err := ReadBytecodeWithEntry(r)
+	return words, err
+}
+
+// BytecodeEntry is the prefix of the bytecode line specifying the
+// entry point. See the package documentation for more information.
+const BytecodeEntry = "# entry:"
+
+// BytecodeChecksum is the prefix of the bytecode line specifying the
+// checksum. See the package documentation for more information.
+const BytecodeChecksum = "# checksum:"
+
+// Checksum returns the checksum of the words, i.e., the CRC-32 (IEEE)
+// of the words serialized as little endian 32-bit numbers.
+func Checksum(words []uint32) uint32 {
+	data := make([]byte, 4*len(words))
+	for idx, word := range words {
+		binary.LittleEndian.PutUint32(data[4*idx:], word)
+	}
+	return crc32.ChecksumIEEE(data)
+}
+
+// ReadBytecodeWithEntry is like ReadBytecode except that it also returns
+// the entry point of the program, which is zero unless specified. When the
+// bytecode contains a checksum, this function fails with ErrChecksum if
+// the checksum of the words does not match it.
+func ReadBytecodeWithEntry(r io.Reader) ([]uint32, uint32, error) {
+	var (
+		checksum *uint32
+		entry    uint32
+		words    []uint32
+	)
 	scanner := bufio.NewScanner(r)
-	var addr uint32
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, BytecodeChecksum) {
+			value, err := strconv.ParseUint(
+				strings.TrimSpace(strings.TrimPrefix(line, BytecodeChecksum)), 0, 32)
+			if err != nil {
+				return nil, 0, err
+			}
+			checksum = new(uint32)
+			*checksum = uint32(value)
+			continue
+		}
+		if strings.HasPrefix(line, BytecodeEntry) {
+			value, err := strconv.ParseUint(
+				strings.TrimSpace(strings.TrimPrefix(line, BytecodeEntry)), 0, 32)
+			if err != nil {
+				return nil, 0, err
+			}
+			entry = uint32(value)
+			continue
+		}
 		if index := strings.Index(line, "#"); index >= 0 {
 			line = line[:index]
 		}
 		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
 		value, err := strconv.ParseUint(line, 0, 32)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		vm.M[addr] = uint32(value)
-		addr++
+		words = append(words, uint32(value))
 	}
 	if err := scanner.Err(); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	return vm, nil
+	if checksum != nil && *checksum != Checksum(words) {
+		return nil, 0, fmt.Errorf("%w: expected 0x%08x, found 0x%08x",
+			ErrChecksum, *checksum, Checksum(words))
+	}
+	return words, entry, nil
 }
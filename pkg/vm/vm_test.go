@@ -0,0 +1,395 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/risc32/pkg/asm"
+)
+
+// assembleVM assembles source and loads it at address zero of a new VM
+// with memWords words of memory. It returns the VM and the address of
+// each label, and fails the test if the assembler emits any error.
+func assembleVM(t *testing.T, memWords uint32, source string) (*VM, map[string]uint32) {
+	var words []uint32
+	labels := make(map[string]uint32)
+	for instr := range asm.StartAssembler(strings.NewReader(source)) {
+		if instr.Error != nil {
+			t.Fatal(instr.Error)
+		}
+		if instr.Label != "" {
+			labels[instr.Label] = instr.Address
+		}
+		words = append(words, instr.Instruction)
+	}
+	machine := NewVM(memWords)
+	if err := machine.Load(words, 0); err != nil {
+		t.Fatal(err)
+	}
+	return machine, labels
+}
+
+// stepUntil steps the VM until the PC reaches addr.
+func stepUntil(t *testing.T, machine *VM, addr uint32) {
+	for steps := 0; machine.PC != addr; steps++ {
+		if steps >= 1<<16 {
+			t.Fatalf("PC did not reach 0x%08x", addr)
+		}
+		if _, err := machine.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// userModeProgram uses WSR to enter user mode with paging enabled
+// while the next instruction is on page zero. The test maps page zero.
+const userModeProgram = `
+        movi r1 ptbl
+        wsr r1 1
+        addi r8 r0 StatusUserMode
+        addi r8 r8 StatusPaging
+        wsr r8 0
+user:   addi r9 r0 1
+        halt
+        .align 10
+ptbl:   .space 1024
+`
+
+func TestWSRUserModeChecksTheNextFetch(t *testing.T) {
+	machine, labels := assembleVM(t, 1<<12, userModeProgram)
+	// identity map page zero as readable and writeable, but not executable
+	if err := machine.WriteMem(labels["ptbl"], MemoryRead|MemoryWrite); err != nil {
+		t.Fatal(err)
+	}
+	stepUntil(t, machine, labels["user"])
+	if machine.S[0] != StatusUserMode|StatusPaging {
+		t.Fatalf("unexpected S[0]: %#x", machine.S[0])
+	}
+	_, err := machine.Step()
+	var fault *FaultError
+	if !errors.As(err, &fault) {
+		t.Fatalf("expected a FaultError, got %v", err)
+	}
+	if !fault.Fetch || fault.Missing != MemoryExec || fault.Virtual != labels["user"] {
+		t.Fatalf("unexpected fault: %+v", fault)
+	}
+}
+
+func TestWSRUserModeExecutesFromExecPage(t *testing.T) {
+	machine, labels := assembleVM(t, 1<<12, userModeProgram)
+	flags := uint32(MemoryRead | MemoryWrite | MemoryExec)
+	if err := machine.WriteMem(labels["ptbl"], flags); err != nil {
+		t.Fatal(err)
+	}
+	stepUntil(t, machine, labels["user"])
+	if _, err := machine.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if machine.GPR[9] != 1 {
+		t.Fatalf("expected r9=1, got %d", machine.GPR[9])
+	}
+}
+
+// pageFaultProgram identity maps page zero, enters user mode, and reads
+// from the unmapped page seven. The IrqPageFault handler copies S[4] into
+// r10 and halts. The .equ allows the test to choose the S[0] flags.
+const pageFaultProgram = `
+        movi r1 itbl
+        wsr r1 2
+        movi r8 irq4
+        sw r8 r1 IrqPageFault
+        movi r8 istack
+        wsr r8 3
+        movi r1 ptbl
+        wsr r1 1
+        addi r8 r0 7
+        sw r8 r1 0
+        movi r2 0x1c00
+        addi r8 r0 FLAGS
+        wsr r8 0
+user:   lw r9 r2 5
+        halt
+irq4:   rsr r10 4
+        halt
+        .align 10
+itbl:   .space 1024
+ptbl:   .space 1024
+        .space 1024
+istack: .fill 0
+`
+
+func TestPageFaultInterrupt(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // Interrupt logs
+	defer log.SetOutput(os.Stderr)
+	flags := StatusUserMode | StatusPaging | StatusInterrupts
+	source := fmt.Sprintf(".equ FLAGS %d\n%s", flags, pageFaultProgram)
+	machine, labels := assembleVM(t, 1<<13, source)
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if machine.GPR[10] != 0x1c05 || machine.S[4] != 0x1c05 {
+		t.Fatalf("unexpected fault address: r10=%#x S[4]=%#x", machine.GPR[10], machine.S[4])
+	}
+	if machine.IPC != labels["user"] || machine.IS0 != uint32(flags) {
+		t.Fatalf("unexpected saved state: IPC=%#x IS0=%#x", machine.IPC, machine.IS0)
+	}
+	if machine.GPR[9] != 0 {
+		t.Fatalf("the faulting LW wrote r9: %#x", machine.GPR[9])
+	}
+}
+
+func TestPageFaultWithInterruptsDisabled(t *testing.T) {
+	flags := StatusUserMode | StatusPaging
+	source := fmt.Sprintf(".equ FLAGS %d\n%s", flags, pageFaultProgram)
+	machine, labels := assembleVM(t, 1<<13, source)
+	err := machine.Run()
+	var fault *FaultError
+	if !errors.As(err, &fault) || !errors.Is(err, ErrNotPermitted) {
+		t.Fatalf("expected a FaultError wrapping ErrNotPermitted, got %v", err)
+	}
+	if fault.Virtual != 0x1c05 || fault.Fetch {
+		t.Fatalf("unexpected fault: %+v", fault)
+	}
+	if machine.GPR[10] != 0 || machine.PC != labels["user"]+1 {
+		t.Fatalf("the handler should not have run: r10=%#x PC=%#x", machine.GPR[10], machine.PC)
+	}
+}
+
+// nestedProgram enables interrupts and traps into irq1, which enables
+// interrupts again and traps into irq2. Both handlers use the stack.
+const nestedProgram = `
+        movi r1 itbl
+        wsr r1 2
+        movi r8 irq1
+        sw r8 r1 1
+        movi r8 irq2
+        sw r8 r1 2
+        movi r8 istack
+        wsr r8 3
+        addi r29 r0 100
+        addi r8 r0 StatusInterrupts
+        wsr r8 0
+        trap 1
+ret1:   wsr r0 0
+        halt
+irq1:   addi r29 r29 -1
+        wsr r8 0
+        trap 2
+ret2:   iret
+irq2:   addi r29 r29 -1
+        iret
+        .align 10
+itbl:   .space 1024
+        .space 1024
+istack: .fill 0
+`
+
+func TestNestedInterrupts(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // Interrupt logs
+	defer log.SetOutput(os.Stderr)
+	machine, labels := assembleVM(t, 1<<12, nestedProgram)
+	stepUntil(t, machine, labels["irq2"]+1)
+	if machine.IN != 2 || len(machine.IST) != 1 || machine.S[0] != 0 {
+		t.Fatalf("unexpected state: IN=%d IST=%+v S[0]=%#x", machine.IN, machine.IST, machine.S[0])
+	}
+	var expect = []struct {
+		pc, sp uint32
+		in     uint32
+	}{
+		{labels["ret2"], labels["istack"] - 1, 1}, // back into irq1
+		{labels["ret1"], 100, 0},                  // back into the program
+	}
+	for idx, e := range expect {
+		if _, err := machine.Step(); err != nil { // iret
+			t.Fatal(err)
+		}
+		if machine.PC != e.pc || machine.S[0] != StatusInterrupts ||
+			machine.GPR[29] != e.sp || machine.IN != e.in {
+			t.Fatalf("iret #%d: PC=%#x S[0]=%#x r29=%d IN=%d", idx+1,
+				machine.PC, machine.S[0], machine.GPR[29], machine.IN)
+		}
+	}
+	if len(machine.IST) != 0 {
+		t.Fatalf("the saved state stack is not empty: %+v", machine.IST)
+	}
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTooManyNestedInterrupts(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // Interrupt logs
+	defer log.SetOutput(os.Stderr)
+	machine := NewVM(1 << 12)
+	machine.S[2] = 1 << 10
+	for idx := 0; idx < MaxInterruptNesting; idx++ {
+		if err := machine.Interrupt(IrqClock); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := machine.Interrupt(IrqClock); !errors.Is(err, ErrTooManyNestedInterrupts) {
+		t.Fatalf("expected ErrTooManyNestedInterrupts, got %v", err)
+	}
+	if machine.IN != MaxInterruptNesting || len(machine.IST) != MaxInterruptNesting-1 {
+		t.Fatalf("unexpected nesting: IN=%d IST=%d", machine.IN, len(machine.IST))
+	}
+}
+
+func TestSmallVMBoundary(t *testing.T) {
+	machine := NewVM(256)
+	bytecode := "# entry: 0xff\n" + strings.Repeat("0x30820000\n", 256) // lw r2 r1 0
+	if err := machine.LoadBytecode(strings.NewReader(bytecode), 0); err != nil {
+		t.Fatal(err)
+	}
+	if machine.PC != 255 || machine.MemoryWords() != 256 {
+		t.Fatalf("unexpected VM: PC=%d MemoryWords=%d", machine.PC, machine.MemoryWords())
+	}
+	machine.GPR[1] = 255 // the LW reads itself
+	if _, err := machine.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if machine.GPR[2] != 0x30820000 {
+		t.Fatalf("expected r2=0x30820000, got %#x", machine.GPR[2])
+	}
+	var fault *FaultError
+	if _, err := machine.Step(); !errors.As(err, &fault) || !fault.Fetch || fault.Virtual != 256 {
+		t.Fatalf("expected a fetch fault at 256, got %v", err)
+	}
+	machine.PC, machine.GPR[1] = 0, 256
+	if _, err := machine.Step(); !errors.As(err, &fault) || fault.Fetch ||
+		!errors.Is(err, ErrSIGSEGV) || fault.Virtual != 256 {
+		t.Fatalf("expected a LW fault at 256, got %v", err)
+	}
+}
+
+func TestSmallVMLoadBytecodeTooLarge(t *testing.T) {
+	bytecode := strings.Repeat("0x00000000\n", 257)
+	err := NewVM(256).LoadBytecode(strings.NewReader(bytecode), 0)
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Fatalf("expected ErrImageTooLarge, got %v", err)
+	}
+	if _, err := LoadBytecode(strings.NewReader(bytecode)); err != nil {
+		t.Fatal(err) // the default VM is large enough
+	}
+}
+
+func TestPageTableBoundary(t *testing.T) {
+	machine := NewVM(1 << 12)
+	machine.S[0], machine.S[1] = StatusPaging, 1<<10
+	// map the last page table entry onto the physical page three
+	if err := machine.WriteMem(1<<10+NumPageTableEntries-1, 3<<10|MemoryRead); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.WriteMem(3<<10|5, 0x2a); err != nil {
+		t.Fatal(err)
+	}
+	ptr, err := machine.Memory((NumPageTableEntries-1)<<10|5, MemoryRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *ptr != 0x2a {
+		t.Fatalf("expected 0x2a, got %#x", *ptr)
+	}
+	_, err = machine.Memory(NumPageTableEntries<<10, MemoryRead)
+	var fault *FaultError
+	if !errors.As(err, &fault) || !errors.Is(err, ErrSIGSEGV) {
+		t.Fatalf("expected a FaultError wrapping ErrSIGSEGV, got %v", err)
+	}
+	if fault.Reason != "page id beyond the page table" || fault.Translated {
+		t.Fatalf("unexpected fault: %+v", fault)
+	}
+}
+
+func TestFetchDoesNotWrap(t *testing.T) {
+	const n = 64
+	var table = []struct {
+		name  string
+		setup func(machine *VM)
+		pc    uint32 // PC of the faulting fetch
+	}{{
+		name: "top of memory",
+		setup: func(machine *VM) {
+			machine.M[n-1] = 0x10400001 // addi r1 r0 1
+			machine.PC = n - 1
+		},
+		pc: n,
+	}, {
+		name: "top of the address space",
+		setup: func(machine *VM) {
+			machine.M[0] = 0x07c20000 // jalr r31 r1
+			machine.GPR[1] = math.MaxUint32
+		},
+		pc: math.MaxUint32,
+	}}
+	for _, entry := range table {
+		machine := NewVM(n)
+		machine.PhysicalMemory()
+		entry.setup(machine)
+		if _, err := machine.Step(); err != nil {
+			t.Fatalf("%s: %s", entry.name, err)
+		}
+		if machine.PC != entry.pc {
+			t.Fatalf("%s: unexpected PC: %#x", entry.name, machine.PC)
+		}
+		if _, err := machine.Step(); !errors.Is(err, ErrSIGSEGV) {
+			t.Fatalf("%s: expected ErrSIGSEGV, got %v", entry.name, err)
+		}
+		if machine.PC != entry.pc {
+			t.Fatalf("%s: the PC has changed to %#x", entry.name, machine.PC)
+		}
+	}
+}
+
+func TestLazyMemory(t *testing.T) {
+	program := []uint32{
+		OpcodeLW<<27 | 3<<22 | 2<<17,     // lw r3 r2 0 (never written)
+		OpcodeSW<<27 | 1<<22 | 2<<17,     // sw r1 r2 0
+		OpcodeLW<<27 | 4<<22 | 2<<17,     // lw r4 r2 0
+		OpcodeLW<<27 | 5<<22 | 2<<17 | 1, // lw r5 r2 1 (never written)
+	}
+	run := func(machine *VM) [NumRegisters]uint32 {
+		machine.GPR[1], machine.GPR[2] = 0xdeadbeef, 100
+		for _, ci := range program {
+			if err := machine.Execute(ci); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return machine.GPR
+	}
+	for _, poison := range []bool{false, true} {
+		fresh := NewVM(1 << 10)
+		fresh.PoisonMemory = poison
+		if fresh.M != nil {
+			t.Fatal("expected memory to be allocated lazily")
+		}
+		touched := NewVM(1 << 10)
+		touched.PoisonMemory = poison
+		touched.PhysicalMemory()
+		if got, expect := run(fresh), run(touched); got != expect {
+			t.Fatalf("poison=%v: expected %v, got %v", poison, expect, got)
+		}
+		if fresh.GPR[4] != 0xdeadbeef {
+			t.Fatalf("poison=%v: expected r4=0xdeadbeef, got %#x", poison, fresh.GPR[4])
+		}
+		if poison && fresh.GPR[3] != PoisonWord {
+			t.Fatalf("expected r3=PoisonWord, got %#x", fresh.GPR[3])
+		}
+	}
+}
+
+// benchmarkVM prevents the compiler from optimizing NewVM away.
+var benchmarkVM *VM
+
+// BenchmarkNewVM shows that creating a VM does not allocate its memory.
+func BenchmarkNewVM(b *testing.B) {
+	b.ReportAllocs()
+	for idx := 0; idx < b.N; idx++ {
+		benchmarkVM = NewVM(0)
+	}
+}
@@ -0,0 +1,61 @@
+#
+# This example shows how the kernel can handle page faults. We identity
+# map the first eight pages and then we access the tenth page, which is
+# not mapped. The page fault handler maps the page and returns, so that
+# the faulting LW is executed again, and this time it succeeds.
+#
+            movi r1 _boot
+            jalr r0 r1
+            .space 1021     # align to occupy a page
+__itbl:     .space 1024     # one page
+__ptbl:     .space 1024     # one page
+__istack:   .space 1024     # one page
+
+_boot:      movi r1 __itbl  # set interrupt handler base address
+            wsr r1 2
+
+            # set interrupt handler for interrupt zero (halt)
+            movi r8 __irq0
+            sw r8 r1 0
+
+            # set interrupt handler for interrupt four (page fault)
+            movi r8 __irq4
+            sw r8 r1 4
+
+            # set stack for interrupt handling
+            movi r8 __istack
+            wsr r8 3
+
+            # store 42 at the beginning of the tenth page
+            movi r2 10240
+            addi r5 r0 42
+            sw r5 r2 0
+
+            # identity map the first eight pages as rwx
+            movi r1 __ptbl
+            wsr r1 1
+            addi r3 r0 8
+            addi r4 r0 7
+__fill:     sw r4 r1 0
+            addi r1 r1 1
+            addi r4 r4 1024
+            addi r3 r3 -1
+            bne r3 r0 __fill
+
+            # enable paging and interrupts
+            addi r8 r0 6
+            wsr r8 0
+
+            # read from the tenth page (faults the first time)
+            lw r9 r2 0
+
+            # stop the machine
+            halt
+
+__irq0:     halt                # interrupts are disabled, so we halt
+
+__irq4:     rsr r8 4            # r8 = faulting address
+            movi r9 __ptbl
+            movi r10 10246      # (10<<10|6 aka rw-)
+            sw r10 r9 10        # map the tenth page
+            iret                # execute the faulting LW again